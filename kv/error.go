@@ -34,6 +34,7 @@ const (
 	codeNotImplemented                            = 10
 	codeTxnTooLarge                               = 11
 	codeEntryTooLarge                             = 12
+	codeMaxExecTimeExceeded                       = 13
 
 	codeKeyExists = 1062
 )
@@ -60,6 +61,8 @@ var (
 	ErrTxnTooLarge = terror.ClassKV.New(codeTxnTooLarge, "transaction is too large")
 	// ErrEntryTooLarge is the error when a key value entry is too large.
 	ErrEntryTooLarge = terror.ClassKV.New(codeEntryTooLarge, "entry is too large")
+	// ErrMaxExecTimeExceeded is the error when a transaction runs longer than its MaxExecutionTime.
+	ErrMaxExecTimeExceeded = terror.ClassKV.New(codeMaxExecTimeExceeded, "transaction exceeds max execution time")
 
 	// ErrNotCommitted is the error returned by CommitVersion when this
 	// transaction is not committed.
@@ -38,6 +38,20 @@ const (
 	IsolationLevel
 	// Priority marks the priority of this transaction.
 	Priority
+	// SkipLazyCheck skips checking lazy condition pairs when committing the transaction.
+	SkipLazyCheck
+	// MemBufferLimit limits the size in bytes of the transaction's membuffer. Writes fail
+	// with ErrTxnTooLarge if the size would exceed it.
+	MemBufferLimit
+	// MemBufferEntryLimit limits the number of entries in the transaction's membuffer.
+	// Writes fail with ErrTxnTooLarge if the number would exceed it.
+	MemBufferEntryLimit
+	// SkipBinlog skips writing the binlog of the transaction if it is set to true,
+	// even if BinlogInfo is set.
+	SkipBinlog
+	// MaxExecutionTime limits the time.Duration a transaction can run. Reads, writes
+	// and the commit fail with ErrMaxExecTimeExceeded once the transaction runs longer.
+	MaxExecutionTime
 )
 
 // Priority value for transaction priority.
@@ -106,6 +106,11 @@ func (m *memDbBuffer) Delete(k Key) error {
 	return errors.Trace(err)
 }
 
+// remove removes k from the buffer, unlike Delete, which buffers a deletion.
+func (m *memDbBuffer) remove(k Key) {
+	m.db.Delete(k)
+}
+
 // Size returns sum of keys and values length.
 func (m *memDbBuffer) Size() int {
 	return m.db.Size()
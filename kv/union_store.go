@@ -28,6 +28,15 @@ type UnionStore interface {
 	CheckLazyConditionPairs() error
 	// WalkBuffer iterates all buffered kv pairs.
 	WalkBuffer(f func(k Key, v []byte) error) error
+	// GetMemBuffer returns the buffer of the union store for reads. Writes should
+	// go through the union store.
+	GetMemBuffer() MemBuffer
+	// SaveCheckpoint returns a checkpoint of the buffered kv pairs and the lazy
+	// condition pairs, which can be restored by RestoreCheckpoint.
+	SaveCheckpoint() UnionStoreCheckpoint
+	// RestoreCheckpoint discards the writes and the lazy condition pairs after
+	// the checkpoint. The checkpoints saved after it become invalid.
+	RestoreCheckpoint(cp UnionStoreCheckpoint) error
 	// SetOption sets an option with a value, when val is nil, uses the default
 	// value of this option.
 	SetOption(opt Option, val interface{})
@@ -61,6 +70,26 @@ type unionStore struct {
 	snapshot           Snapshot                    // for read
 	lazyConditionPairs map[string](*conditionPair) // for delay check
 	opts               options
+	// undoLog records how to undo the writes and lazy condition pairs since
+	// the first checkpoint is saved.
+	undoLog    []undoEntry
+	undoLogged bool
+}
+
+// UnionStoreCheckpoint is a checkpoint of a UnionStore, see
+// UnionStore.SaveCheckpoint.
+type UnionStoreCheckpoint struct {
+	undoLen int
+}
+
+// undoEntry is the state of a key before a write or the lazy condition pair
+// of a key before it is marked.
+type undoEntry struct {
+	key    Key
+	lazy   bool
+	exists bool
+	value  []byte
+	pair   *conditionPair
 }
 
 // NewUnionStore builds a new UnionStore.
@@ -151,6 +180,13 @@ func (lmb *lazyMemBuffer) Len() int {
 	return lmb.mb.Len()
 }
 
+// remove removes k from the buffer, unlike Delete, which buffers a deletion.
+func (lmb *lazyMemBuffer) remove(k Key) {
+	if lmb.mb != nil {
+		lmb.mb.(*memDbBuffer).remove(k)
+	}
+}
+
 // Get implements the Retriever interface.
 func (us *unionStore) Get(k Key) ([]byte, error) {
 	v, err := us.MemBuffer.Get(k)
@@ -180,6 +216,10 @@ func (us *unionStore) Get(k Key) ([]byte, error) {
 // markLazyConditionPair marks a kv pair for later check.
 // If condition not match, should return e as error.
 func (us *unionStore) markLazyConditionPair(k Key, v []byte, e error) {
+	if us.undoLogged {
+		pair, ok := us.lazyConditionPairs[string(k)]
+		us.undoLog = append(us.undoLog, undoEntry{key: k.Clone(), lazy: true, exists: ok, pair: pair})
+	}
 	us.lazyConditionPairs[string(k)] = &conditionPair{
 		key:   k.Clone(),
 		value: v,
@@ -187,6 +227,70 @@ func (us *unionStore) markLazyConditionPair(k Key, v []byte, e error) {
 	}
 }
 
+// Set implements the Mutator interface.
+func (us *unionStore) Set(k Key, v []byte) error {
+	us.logUndo(k)
+	return us.MemBuffer.Set(k, v)
+}
+
+// Delete implements the Mutator interface.
+func (us *unionStore) Delete(k Key) error {
+	us.logUndo(k)
+	return us.MemBuffer.Delete(k)
+}
+
+// logUndo records the buffered state of k before it is written.
+func (us *unionStore) logUndo(k Key) {
+	if !us.undoLogged {
+		return
+	}
+	entry := undoEntry{key: k.Clone()}
+	if v, err := us.MemBuffer.Get(k); err == nil {
+		entry.exists = true
+		entry.value = append([]byte(nil), v...)
+	}
+	us.undoLog = append(us.undoLog, entry)
+}
+
+// GetMemBuffer implements the UnionStore interface.
+func (us *unionStore) GetMemBuffer() MemBuffer {
+	return us.BufferStore.MemBuffer
+}
+
+// SaveCheckpoint implements the UnionStore interface.
+func (us *unionStore) SaveCheckpoint() UnionStoreCheckpoint {
+	us.undoLogged = true
+	return UnionStoreCheckpoint{undoLen: len(us.undoLog)}
+}
+
+// RestoreCheckpoint implements the UnionStore interface.
+func (us *unionStore) RestoreCheckpoint(cp UnionStoreCheckpoint) error {
+	if cp.undoLen > len(us.undoLog) {
+		return errors.Errorf("invalid checkpoint %d, undo log length %d", cp.undoLen, len(us.undoLog))
+	}
+	for i := len(us.undoLog) - 1; i >= cp.undoLen; i-- {
+		entry := us.undoLog[i]
+		var err error
+		switch {
+		case entry.lazy && entry.exists:
+			us.lazyConditionPairs[string(entry.key)] = entry.pair
+		case entry.lazy:
+			delete(us.lazyConditionPairs, string(entry.key))
+		case !entry.exists:
+			us.MemBuffer.(*lazyMemBuffer).remove(entry.key)
+		case len(entry.value) == 0:
+			err = us.MemBuffer.Delete(entry.key)
+		default:
+			err = us.MemBuffer.Set(entry.key, entry.value)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	us.undoLog = us.undoLog[:cp.undoLen]
+	return nil
+}
+
 // CheckLazyConditionPairs implements the UnionStore interface.
 func (us *unionStore) CheckLazyConditionPairs() error {
 	if len(us.lazyConditionPairs) == 0 {
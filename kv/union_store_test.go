@@ -125,6 +125,41 @@ func (s *testUnionStoreSuite) TestLazyConditionCheck(c *C) {
 	c.Assert(err, NotNil)
 }
 
+func (s *testUnionStoreSuite) TestCheckpoint(c *C) {
+	defer testleak.AfterTest(c)()
+	s.store.Set([]byte("2"), []byte("2"))
+	s.us.Set([]byte("1"), []byte("1"))
+	s.us.Delete([]byte("3"))
+	cp := s.us.SaveCheckpoint()
+	s.us.Set([]byte("1"), []byte("11"))
+	s.us.Delete([]byte("1"))
+	s.us.Set([]byte("3"), []byte("3"))
+	s.us.Set([]byte("4"), []byte("4"))
+	s.us.SetOption(PresumeKeyNotExists, nil)
+	_, err := s.us.Get([]byte("2"))
+	c.Assert(terror.ErrorEqual(err, ErrNotExist), IsTrue)
+	c.Assert(s.us.CheckLazyConditionPairs(), NotNil)
+
+	c.Assert(s.us.RestoreCheckpoint(cp), IsNil)
+	c.Assert(s.us.CheckLazyConditionPairs(), IsNil)
+	s.us.DelOption(PresumeKeyNotExists)
+	v, err := s.us.Get([]byte("1"))
+	c.Assert(err, IsNil)
+	c.Assert(v, BytesEquals, []byte("1"))
+	_, err = s.us.Get([]byte("3"))
+	c.Assert(terror.ErrorEqual(err, ErrNotExist), IsTrue)
+	_, err = s.us.Get([]byte("4"))
+	c.Assert(terror.ErrorEqual(err, ErrNotExist), IsTrue)
+	c.Assert(s.us.Len(), Equals, 2)
+
+	// The checkpoints saved after a restored one become invalid.
+	cp1 := s.us.SaveCheckpoint()
+	s.us.Set([]byte("5"), []byte("5"))
+	cp2 := s.us.SaveCheckpoint()
+	c.Assert(s.us.RestoreCheckpoint(cp1), IsNil)
+	c.Assert(s.us.RestoreCheckpoint(cp2), NotNil)
+}
+
 func checkIterator(c *C, iter Iterator, keys [][]byte, values [][]byte) {
 	defer iter.Close()
 	c.Assert(len(keys), Equals, len(values))
@@ -74,6 +74,12 @@ type twoPhaseCommitter struct {
 		undetermined bool
 	}
 	priority pb.CommandPri
+	// syncCommit makes secondary batches be committed in the caller's
+	// goroutine instead of in background.
+	syncCommit bool
+	// retryCount is the number of times prewrite requests are retried because
+	// of locks or region errors.
+	retryCount int32
 }
 
 // newTwoPhaseCommitter creates a twoPhaseCommitter.
@@ -216,11 +222,14 @@ func (c *twoPhaseCommitter) doActionOnKeys(bo *Backoffer, action twoPhaseCommitA
 		}
 		batches = batches[1:]
 	}
-	if action == actionCommit {
+	if action == actionCommit && !c.syncCommit {
 		// Commit secondary batches in background goroutine to reduce latency.
+		// The primary key may be committed already, so the secondary batches
+		// should not be canceled together with the caller's context.
+		secondaryBo := NewBackoffer(commitMaxBackoff, goctx.Background())
 		go func() {
 			reserveStack(false)
-			e := c.doActionOnBatches(bo, action, batches)
+			e := c.doActionOnBatches(secondaryBo, action, batches)
 			if e != nil {
 				log.Debugf("2PC async doActionOnBatches %s err: %v", action, e)
 			}
@@ -352,6 +361,7 @@ func (c *twoPhaseCommitter) prewriteSingleBatch(bo *Backoffer, batch batchKeys)
 			if err != nil {
 				return errors.Trace(err)
 			}
+			atomic.AddInt32(&c.retryCount, 1)
 			err = c.prewriteKeys(bo, batch.keys)
 			return errors.Trace(err)
 		}
@@ -394,6 +404,7 @@ func (c *twoPhaseCommitter) prewriteSingleBatch(bo *Backoffer, batch batchKeys)
 				return errors.Trace(err)
 			}
 		}
+		atomic.AddInt32(&c.retryCount, 1)
 	}
 }
 
@@ -529,8 +540,9 @@ func (c *twoPhaseCommitter) cleanupKeys(bo *Backoffer, keys [][]byte) error {
 // should be less than `gcRunInterval`.
 const maxTxnTimeUse = 590000
 
-// execute executes the two-phase commit protocol.
-func (c *twoPhaseCommitter) execute() error {
+// execute executes the two-phase commit protocol. Canceling ctx aborts the
+// commit unless the primary key is committed.
+func (c *twoPhaseCommitter) execute(ctx goctx.Context) error {
 	defer func() {
 		// Always clean up all written keys if the txn does not commit.
 		c.mu.RLock()
@@ -551,7 +563,10 @@ func (c *twoPhaseCommitter) execute() error {
 		}
 	}()
 
-	ctx := goctx.Background()
+	if err := c.validateMutations(); err != nil {
+		return errors.Trace(err)
+	}
+
 	binlogChan := c.prewriteBinlog()
 	err := c.prewriteKeys(NewBackoffer(prewriteMaxBackoff, ctx), c.keys)
 	if binlogChan != nil {
@@ -562,9 +577,40 @@ func (c *twoPhaseCommitter) execute() error {
 	}
 	if err != nil {
 		log.Debugf("2PC failed on prewrite: %v, tid: %d", err, c.startTS)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// change the Cause of the error to be returned
+			return errors.Trace(errors.Wrap(err, ctxErr))
+		}
+		return errors.Trace(err)
+	}
+
+	if err = c.getCommitTS(ctx); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Nothing is committed yet, it's still safe to give up.
+	if err = ctx.Err(); err != nil {
+		log.Debugf("2PC canceled before commit: %v, tid: %d", err, c.startTS)
 		return errors.Trace(err)
 	}
 
+	err = c.commitKeys(NewBackoffer(commitMaxBackoff, ctx), c.keys)
+	if err != nil {
+		if errors.Cause(err) == terror.ErrResultUndetermined {
+			c.mu.undetermined = true
+		}
+		if !c.mu.committed {
+			log.Debugf("2PC failed on commit: %v, tid: %d", err, c.startTS)
+			return errors.Trace(err)
+		}
+		log.Debugf("2PC succeed with error: %v, tid: %d", err, c.startTS)
+	}
+	return nil
+}
+
+// getCommitTS fetches the commit ts and checks that the transaction can still
+// be committed with it.
+func (c *twoPhaseCommitter) getCommitTS(ctx goctx.Context) error {
 	commitTS, err := c.store.getTimestampWithRetry(NewBackoffer(tsoMaxBackoff, ctx))
 	if err != nil {
 		log.Warnf("2PC get commitTS failed: %v, tid: %d", err, c.startTS)
@@ -588,19 +634,20 @@ func (c *twoPhaseCommitter) execute() error {
 		err = errors.Errorf("txn takes too much time, start: %d, commit: %d", c.startTS, c.commitTS)
 		return errors.Annotate(err, txnRetryableMark)
 	}
+	return nil
+}
 
-	err = c.commitKeys(NewBackoffer(commitMaxBackoff, ctx), c.keys)
-	if err != nil {
-		if errors.Cause(err) == terror.ErrResultUndetermined {
-			c.mu.undetermined = true
-		}
-		if !c.mu.committed {
-			log.Debugf("2PC failed on commit: %v, tid: %d", err, c.startTS)
-			return errors.Trace(err)
-		}
-		log.Debugf("2PC succeed with error: %v, tid: %d", err, c.startTS)
+// validateMutations calls the transaction's pre-commit validator with all the
+// mutations, the primary key goes first.
+func (c *twoPhaseCommitter) validateMutations() error {
+	if c.txn.preCommitValidator == nil {
+		return nil
 	}
-	return nil
+	mutations := make([]*pb.Mutation, 0, len(c.keys))
+	for _, k := range c.keys {
+		mutations = append(mutations, c.mutations[string(k)])
+	}
+	return errors.Trace(c.txn.preCommitValidator(mutations))
 }
 
 type schemaLeaseChecker interface {
@@ -652,6 +699,9 @@ func (c *twoPhaseCommitter) writeFinishBinlog(tp binlog.BinlogType, commitTS int
 }
 
 func (c *twoPhaseCommitter) shouldWriteBinlog() bool {
+	if skip, ok := c.txn.us.GetOption(kv.SkipBinlog).(bool); ok && skip {
+		return false
+	}
 	return c.txn.us.GetOption(kv.BinlogInfo) != nil
 }
 
@@ -14,6 +14,7 @@
 package tikv
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"strings"
@@ -23,10 +24,14 @@ import (
 	. "github.com/pingcap/check"
 	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/sessionctx/binloginfo"
 	"github.com/pingcap/tidb/store/tikv/mock-tikv"
 	"github.com/pingcap/tidb/store/tikv/tikvrpc"
 	"github.com/pingcap/tidb/terror"
+	"github.com/pingcap/tipb/go-binlog"
 	goctx "golang.org/x/net/context"
+	"google.golang.org/grpc"
 )
 
 type testCommitterSuite struct {
@@ -322,6 +327,20 @@ func (s *testCommitterSuite) TestCommitBeforePrewrite(c *C) {
 	errMsgMustContain(c, err, "write conflict")
 }
 
+func (s *testCommitterSuite) TestWriteConflictError(c *C) {
+	txn1 := s.begin(c)
+	txn2 := s.begin(c)
+	c.Assert(txn1.Set([]byte("a"), []byte("a1")), IsNil)
+	c.Assert(txn1.Set([]byte("b"), []byte("b1")), IsNil)
+	c.Assert(txn1.Commit(), IsNil)
+	c.Assert(txn2.Set([]byte("b"), []byte("b2")), IsNil)
+	err := txn2.Commit()
+	c.Assert(kv.IsRetryableError(err), IsTrue)
+	// The details of the conflict are kept in the error message.
+	errMsgMustContain(c, err, "write conflict")
+	errMsgMustContain(c, err, fmt.Sprintf("conflictTS: %d", txn1.commitTS))
+}
+
 func (s *testCommitterSuite) TestPrewritePrimaryKeyFailed(c *C) {
 	// commit (a,a1)
 	txn1 := s.begin(c)
@@ -495,3 +514,111 @@ func (s *testCommitterSuite) TestCommitTimeout(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(len(value), Greater, 0)
 }
+
+func (s *testCommitterSuite) TestCommitWithContextCanceled(c *C) {
+	txn := s.begin(c)
+	txn.Set([]byte("a"), []byte("a1"))
+	txn.Set([]byte("b"), []byte("b1"))
+	ctx, cancel := goctx.WithCancel(goctx.Background())
+	cancel()
+	err := txn.CommitWithContext(ctx)
+	c.Assert(errors.Cause(err), Equals, goctx.Canceled)
+
+	txn = s.begin(c)
+	_, err = txn.Get([]byte("a"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+}
+
+func (s *testCommitterSuite) TestCommitWithContextDeadline(c *C) {
+	txn := s.begin(c)
+	txn.Set([]byte("a"), []byte("a1"))
+	ctx, cancel := goctx.WithTimeout(goctx.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	err := txn.CommitWithContext(ctx)
+	c.Assert(errors.Cause(err), Equals, goctx.DeadlineExceeded)
+}
+
+// cancelOnCommitClient cancels the context after the first commit request is sent.
+type cancelOnCommitClient struct {
+	Client
+	cancel goctx.CancelFunc
+}
+
+func (c *cancelOnCommitClient) SendReq(ctx goctx.Context, addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+	resp, err := c.Client.SendReq(ctx, addr, req)
+	if req.Type == tikvrpc.CmdCommit {
+		c.cancel()
+	}
+	return resp, err
+}
+
+func (s *testCommitterSuite) TestCommitWithContextCanceledAfterPrimary(c *C) {
+	ctx, cancel := goctx.WithCancel(goctx.Background())
+	s.store.client = &cancelOnCommitClient{Client: s.store.client, cancel: cancel}
+
+	txn := s.begin(c)
+	txn.Set([]byte("a"), []byte("a1"))
+	txn.Set([]byte("b"), []byte("b1"))
+	txn.Set([]byte("c"), []byte("c1"))
+	// The primary key is committed before the context is canceled.
+	c.Assert(txn.CommitWithContext(ctx), IsNil)
+	s.checkValues(c, map[string]string{
+		"a": "a1",
+		"b": "b1",
+		"c": "c1",
+	})
+}
+
+// mockPumpClient sends the binlogs written to it to ch.
+type mockPumpClient struct {
+	ch chan *binlog.Binlog
+}
+
+func (p *mockPumpClient) WriteBinlog(ctx goctx.Context, req *binlog.WriteBinlogReq, opts ...grpc.CallOption) (*binlog.WriteBinlogResp, error) {
+	var bin binlog.Binlog
+	if err := bin.Unmarshal(req.Payload); err != nil {
+		return nil, errors.Trace(err)
+	}
+	p.ch <- &bin
+	return &binlog.WriteBinlogResp{}, nil
+}
+
+func (p *mockPumpClient) PullBinlogs(ctx goctx.Context, req *binlog.PullBinlogReq, opts ...grpc.CallOption) (binlog.Pump_PullBinlogsClient, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *testCommitterSuite) TestSkipBinlog(c *C) {
+	client := &mockPumpClient{ch: make(chan *binlog.Binlog, 10)}
+	commitWithBinlog := func(skip bool) *tikvTxn {
+		txn := s.begin(c)
+		c.Assert(txn.Set([]byte("a"), []byte("a1")), IsNil)
+		txn.SetOption(kv.BinlogInfo, &binloginfo.BinlogInfo{
+			Data:   &binlog.Binlog{Tp: binlog.BinlogType_Prewrite},
+			Client: client,
+		})
+		if skip {
+			txn.SetOption(kv.SkipBinlog, true)
+		}
+		c.Assert(txn.Commit(), IsNil)
+		return txn
+	}
+
+	txn := commitWithBinlog(false)
+	for _, tp := range []binlog.BinlogType{binlog.BinlogType_Prewrite, binlog.BinlogType_Commit} {
+		select {
+		case bin := <-client.ch:
+			c.Assert(bin.Tp, Equals, tp)
+			c.Assert(bin.StartTs, Equals, int64(txn.StartTS()))
+		case <-time.After(time.Second):
+			c.Fatalf("binlog %v is not written", tp)
+		}
+	}
+
+	commitWithBinlog(true)
+	select {
+	case bin := <-client.ch:
+		c.Fatalf("unexpected binlog %v", bin)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
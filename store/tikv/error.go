@@ -24,6 +24,15 @@ var (
 	errInvalidResponse = errors.New("invalid response")
 	// errBodyMissing response body is missing error
 	errBodyMissing = errors.New("response body is missing")
+	// errCommitPhaseOrder is returned if the commit phases of a txn are not
+	// called in order.
+	errCommitPhaseOrder = errors.New("commit phase called out of order")
+	// errInvalidStartTS is returned when beginning a txn with a zero startTS.
+	errInvalidStartTS = errors.New("invalid startTS 0")
+	// errSavepointNotExist is returned when rolling back to an unknown savepoint.
+	errSavepointNotExist = errors.New("savepoint does not exist")
+	// errEmptySavepointName is returned when setting a savepoint without a name.
+	errEmptySavepointName = errors.New("empty savepoint name")
 )
 
 // TiDB decides whether to retry transaction by checking if error message contains
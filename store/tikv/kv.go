@@ -233,8 +233,12 @@ func (s *tikvStore) Begin() (kv.Transaction, error) {
 	return txn, nil
 }
 
-// BeginWithStartTS begins a transaction with startTS.
+// BeginWithStartTS begins a transaction with startTS, which must not be 0. The
+// txn reads the snapshot at startTS, so it can be used to read history data.
 func (s *tikvStore) BeginWithStartTS(startTS uint64) (kv.Transaction, error) {
+	if startTS == 0 {
+		return nil, errors.Trace(errInvalidStartTS)
+	}
 	txn, err := newTikvTxnWithStartTS(s, startTS)
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -243,6 +247,21 @@ func (s *tikvStore) BeginWithStartTS(startTS uint64) (kv.Transaction, error) {
 	return txn, nil
 }
 
+// BeginWithExactStaleness begins a transaction reading the snapshot of prevSec
+// seconds ago, which doesn't see the data committed after that.
+func (s *tikvStore) BeginWithExactStaleness(prevSec uint64) (kv.Transaction, error) {
+	bo := NewBackoffer(tsoMaxBackoff, goctx.Background())
+	ts, err := s.getTimestampWithRetry(bo)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	staleness := oracle.ComposeTS(int64(prevSec)*int64(time.Second/time.Millisecond), 0)
+	if staleness >= ts {
+		return nil, errors.Errorf("invalid staleness %vs, current ts: %v", prevSec, ts)
+	}
+	return s.BeginWithStartTS(ts - staleness)
+}
+
 func (s *tikvStore) GetSnapshot(ver kv.Version) (kv.Snapshot, error) {
 	snapshot := newTiKVSnapshot(s, ver)
 	snapshotCounter.Inc()
@@ -0,0 +1,184 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mocktikv
+
+import (
+	"github.com/juju/errors"
+	"github.com/petar/GoLLRB/llrb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// checkpointVersion is written at the beginning of a checkpoint, so that a
+// checkpoint of another format is rejected by Restore.
+const checkpointVersion = 1
+
+// Checkpoint serializes the whole store, including all versions, locks and
+// raw kvs, to a blob which can be loaded back by Restore. The same state is
+// always serialized to the same blob.
+func (s *MvccStore) Checkpoint() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	b := codec.EncodeUvarint(nil, checkpointVersion)
+	b = codec.EncodeUvarint(b, s.lockSeq)
+	b = codec.EncodeUvarint(b, uint64(s.tree.Len()))
+	s.tree.AscendGreaterOrEqual(newEntry(nil), func(item llrb.Item) bool {
+		b = encodeEntry(b, item.(*mvccEntry))
+		return true
+	})
+	b = codec.EncodeUvarint(b, uint64(s.rawkv.Len()))
+	s.rawkv.AscendGreaterOrEqual(newRawEntry(nil), func(item llrb.Item) bool {
+		ent := item.(*rawEntry)
+		b = encodeCheckpointBytes(b, ent.key)
+		b = encodeCheckpointBytes(b, ent.value)
+		return true
+	})
+	return b, nil
+}
+
+// Restore replaces all data of the store with a blob created by Checkpoint.
+// The store is not changed if the blob fails to be decoded.
+func (s *MvccStore) Restore(blob []byte) error {
+	d := &checkpointDecoder{b: blob}
+	if version := d.uint(); d.err == nil && version != checkpointVersion {
+		return errors.Errorf("unknown checkpoint version %v", version)
+	}
+	lockSeq := d.uint()
+	tree := llrb.New()
+	for n := d.uint(); n > 0 && d.err == nil; n-- {
+		tree.ReplaceOrInsert(d.entry())
+	}
+	rawkv := llrb.New()
+	for n := d.uint(); n > 0 && d.err == nil; n-- {
+		rawkv.ReplaceOrInsert(&rawEntry{key: d.bytes(), value: d.bytes()})
+	}
+	if d.err == nil && len(d.b) > 0 {
+		d.err = errors.Errorf("%d bytes left after the checkpoint", len(d.b))
+	}
+	if d.err != nil {
+		return errors.Trace(d.err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.tree, s.rawkv, s.lockSeq = tree, rawkv, lockSeq
+	return nil
+}
+
+func encodeEntry(b []byte, e *mvccEntry) []byte {
+	b = encodeCheckpointBytes(b, e.key)
+	b = codec.EncodeUvarint(b, uint64(len(e.values)))
+	for _, v := range e.values {
+		b = codec.EncodeUvarint(b, uint64(v.valueType))
+		b = codec.EncodeUvarint(b, v.startTS)
+		b = codec.EncodeUvarint(b, v.commitTS)
+		b = encodeCheckpointBytes(b, v.value)
+	}
+	if e.lock == nil {
+		return codec.EncodeUvarint(b, 0)
+	}
+	l := e.lock
+	b = codec.EncodeUvarint(b, 1)
+	b = codec.EncodeUvarint(b, l.startTS)
+	b = encodeCheckpointBytes(b, l.primary)
+	b = encodeCheckpointBytes(b, l.value)
+	b = codec.EncodeUvarint(b, uint64(l.op))
+	b = codec.EncodeUvarint(b, l.ttl)
+	b = codec.EncodeUvarint(b, l.minCommitTS)
+	b = codec.EncodeUvarint(b, l.forUpdateTS)
+	b = codec.EncodeUvarint(b, l.seq)
+	if l.useAsyncCommit {
+		b = codec.EncodeUvarint(b, 1)
+	} else {
+		b = codec.EncodeUvarint(b, 0)
+	}
+	b = codec.EncodeUvarint(b, uint64(len(l.secondaries)))
+	for _, k := range l.secondaries {
+		b = encodeCheckpointBytes(b, k)
+	}
+	return b
+}
+
+// encodeCheckpointBytes encodes data with its length plus 1, so that nil and
+// empty slices are told apart when decoding.
+func encodeCheckpointBytes(b []byte, data []byte) []byte {
+	if data == nil {
+		return codec.EncodeUvarint(b, 0)
+	}
+	b = codec.EncodeUvarint(b, uint64(len(data))+1)
+	return append(b, data...)
+}
+
+// checkpointDecoder decodes a checkpoint. After an error occurs, the decoding
+// methods return zero values and the error is kept in err.
+type checkpointDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *checkpointDecoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	var v uint64
+	d.b, v, d.err = codec.DecodeUvarint(d.b)
+	return v
+}
+
+func (d *checkpointDecoder) bytes() []byte {
+	n := d.uint()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	n--
+	if uint64(len(d.b)) < n {
+		d.err = errors.Errorf("insufficient bytes to decode, need %d, got %d", n, len(d.b))
+		return nil
+	}
+	data := append([]byte{}, d.b[:n]...)
+	d.b = d.b[n:]
+	return data
+}
+
+func (d *checkpointDecoder) entry() *mvccEntry {
+	e := newEntry(d.bytes())
+	for n := d.uint(); n > 0 && d.err == nil; n-- {
+		e.values = append(e.values, mvccValue{
+			valueType: mvccValueType(d.uint()),
+			startTS:   d.uint(),
+			commitTS:  d.uint(),
+			value:     d.bytes(),
+		})
+	}
+	if d.uint() == 0 {
+		return e
+	}
+	e.lock = &mvccLock{
+		startTS:     d.uint(),
+		primary:     d.bytes(),
+		value:       d.bytes(),
+		op:          kvrpcpb.Op(d.uint()),
+		ttl:         d.uint(),
+		minCommitTS: d.uint(),
+		forUpdateTS: d.uint(),
+		seq:         d.uint(),
+
+		useAsyncCommit: d.uint() == 1,
+	}
+	for n := d.uint(); n > 0 && d.err == nil; n-- {
+		e.lock.secondaries = append(e.lock.secondaries, d.bytes())
+	}
+	return e
+}
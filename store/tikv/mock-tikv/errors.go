@@ -13,7 +13,15 @@
 
 package mocktikv
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+)
+
+// ErrScanLimitExceeded is set as the Err of the last Pair returned by Scan if
+// the result is truncated by the max scan limit of the store.
+var ErrScanLimitExceeded = errors.New("scan limit exceeded")
 
 // ErrLocked is returned when trying to Read/Write on a locked key. Client should
 // backoff or cleanup the lock then retry.
@@ -36,6 +44,24 @@ func (e ErrRetryable) Error() string {
 	return fmt.Sprintf("retryable: %s", string(e))
 }
 
+// ErrWriteConflict is returned when trying to prewrite a key which is written by
+// a transaction that commits after the current transaction starts.
+type ErrWriteConflict struct {
+	Key     MvccKey
+	Primary []byte
+	StartTS uint64
+	// ConflictStartTS and ConflictTS are the start ts and commit ts of the
+	// newer version.
+	ConflictStartTS uint64
+	ConflictTS      uint64
+}
+
+// Error formats the conflict to a string.
+func (e *ErrWriteConflict) Error() string {
+	return fmt.Sprintf("write conflict, key: %q, primary: %q, startTS: %v, conflictStartTS: %v, conflictTS: %v",
+		e.Key, e.Primary, e.StartTS, e.ConflictStartTS, e.ConflictTS)
+}
+
 // ErrAbort means something is wrong and client should abort the txn.
 type ErrAbort string
 
@@ -50,3 +76,72 @@ type ErrAlreadyCommitted uint64
 func (e ErrAlreadyCommitted) Error() string {
 	return fmt.Sprint("txn already committed")
 }
+
+// ErrCommitTSMismatch is returned when committing a transaction which is
+// already committed with a different commitTS.
+type ErrCommitTSMismatch struct {
+	StartTS          uint64
+	CommitTS         uint64
+	ExistingCommitTS uint64
+}
+
+func (e *ErrCommitTSMismatch) Error() string {
+	return fmt.Sprintf("txn %v already committed with commitTS %v, got %v", e.StartTS, e.ExistingCommitTS, e.CommitTS)
+}
+
+// ErrInvalidCommitTS is returned when committing a transaction with a commitTS
+// not greater than its startTS.
+type ErrInvalidCommitTS struct {
+	StartTS  uint64
+	CommitTS uint64
+}
+
+func (e *ErrInvalidCommitTS) Error() string {
+	return fmt.Sprintf("invalid commitTS %v, it should be greater than startTS %v", e.CommitTS, e.StartTS)
+}
+
+// ErrTxnNotFound is returned when the lock of a transaction to be checked or
+// updated doesn't exist.
+type ErrTxnNotFound struct {
+	StartTS    uint64
+	PrimaryKey []byte
+}
+
+func (e *ErrTxnNotFound) Error() string {
+	return fmt.Sprintf("txn %v not found, primary key: %q", e.StartTS, e.PrimaryKey)
+}
+
+// ErrTooManyVersions is returned when committing a key which already has the
+// max number of versions.
+type ErrTooManyVersions struct {
+	Key   []byte
+	Limit int
+}
+
+func (e *ErrTooManyVersions) Error() string {
+	return fmt.Sprintf("too many versions of key %q, limit: %v", e.Key, e.Limit)
+}
+
+// ErrValueTooLarge is returned when prewriting a value larger than the max
+// value size.
+type ErrValueTooLarge struct {
+	Key   []byte
+	Size  int
+	Limit int
+}
+
+func (e *ErrValueTooLarge) Error() string {
+	return fmt.Sprintf("value of key %q is too large, size: %v, limit: %v", e.Key, e.Size, e.Limit)
+}
+
+// ErrCommitTSExpired is returned when committing a lock with a commitTS less
+// than the minCommitTS of the lock.
+type ErrCommitTSExpired struct {
+	StartTS     uint64
+	CommitTS    uint64
+	MinCommitTS uint64
+}
+
+func (e *ErrCommitTSExpired) Error() string {
+	return fmt.Sprintf("commitTS %v of txn %v is less than minCommitTS %v", e.CommitTS, e.StartTS, e.MinCommitTS)
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mocktikv
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	mvccCmdHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "tidb",
+			Subsystem: "mocktikv",
+			Name:      "mvcc_cmd_seconds",
+			Help:      "Bucketed histogram of processing time of mvcc cmds.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 2, 18),
+		}, []string{"type"})
+
+	registerMetricsOnce sync.Once
+)
+
+// RegisterMetrics registers the metrics of the mock store to prometheus. They
+// are not registered by default, so tests that don't need them are not
+// affected. It is safe to call it more than once.
+func RegisterMetrics() {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(mvccCmdHistogram)
+	})
+}
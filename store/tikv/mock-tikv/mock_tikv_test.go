@@ -14,11 +14,20 @@
 package mocktikv
 
 import (
+	"bytes"
+	"fmt"
+	"math/rand"
 	"strings"
 	"testing"
 
+	"github.com/juju/errors"
 	. "github.com/pingcap/check"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"github.com/pingcap/tidb/store/tikv/oracle/oracles"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	goctx "golang.org/x/net/context"
 )
 
 func TestT(t *testing.T) {
@@ -327,3 +336,2084 @@ func (s *testMockTiKVSuite) TestRC(c *C) {
 	s.mustGetRC(c, "key", 12, "v1")
 	s.mustGetRC(c, "key", 20, "v1")
 }
+
+func (s *testMockTiKVSuite) TestRCReadLatestCommitted(c *C) {
+	s.mustPutOK(c, "key", "v1", 5, 10)
+	// v2 is committed after the reader's startTS 12.
+	s.mustPutOK(c, "key", "v2", 15, 20)
+	s.mustGetOK(c, "key", 12, "v1")
+	s.mustGetRC(c, "key", 12, "v2")
+
+	s.mustDeleteOK(c, "key", 25, 30)
+	s.mustGetOK(c, "key", 12, "v1")
+	s.mustGetRC(c, "key", 12, "")
+
+	// A lock doesn't block RC readers, and its value isn't committed yet.
+	s.mustPrewriteOK(c, putMutations("key", "v3"), "key", 35)
+	s.mustGetErr(c, "key", 40)
+	s.mustGetRC(c, "key", 12, "")
+	s.mustCommitOK(c, [][]byte{[]byte("key")}, 35, 36)
+	s.mustGetRC(c, "key", 12, "v3")
+}
+
+func (s *testMockTiKVSuite) TestLockTTLExpire(c *C) {
+	startTS := oracle.ComposeTS(100, 0)
+	errs := s.store.Prewrite(putMutations("x", "x1", "y", "y1"), []byte("x"), startTS, 50)
+	c.Assert(errs, DeepEquals, []error{nil, nil})
+
+	// An expired lock still blocks readers and writers, since its txn may be
+	// committed by the primary key already.
+	newStartTS := oracle.ComposeTS(200, 0)
+	s.mustGetErr(c, "y", newStartTS)
+	errs = s.store.Prewrite(putMutations("y", "y2"), []byte("y"), newStartTS, 50)
+	s.mustLocked(c, errs[0], "y", "x", startTS, 50)
+
+	// The primary is committed, so the expired secondary must be committed too.
+	s.mustCommitOK(c, [][]byte{[]byte("x")}, startTS, startTS+1)
+	s.mustGetErr(c, "y", newStartTS)
+	ttl, commitTS, _, err := s.store.CheckTxnStatus([]byte("x"), startTS, newStartTS, newStartTS)
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(0))
+	c.Assert(commitTS, Equals, startTS+1)
+	s.mustResolveLock(c, startTS, commitTS)
+	s.mustGetOK(c, "y", newStartTS, "y1")
+
+	// A txn whose primary lock is expired is rolled back by CheckTxnStatus.
+	startTS = oracle.ComposeTS(300, 0)
+	errs = s.store.Prewrite(putMutations("x", "x3", "y", "y3"), []byte("x"), startTS, 50)
+	c.Assert(errs, DeepEquals, []error{nil, nil})
+	newStartTS = oracle.ComposeTS(400, 0)
+	_, _, action, err := s.store.CheckTxnStatus([]byte("x"), startTS, newStartTS, newStartTS)
+	c.Assert(err, IsNil)
+	c.Assert(action, Equals, TxnActionTTLExpireRollback)
+	s.mustGetErr(c, "y", newStartTS)
+	s.mustResolveLock(c, startTS, 0)
+	s.mustPrewriteOK(c, putMutations("y", "y4"), "y", newStartTS)
+	s.mustCommitErr(c, [][]byte{[]byte("y")}, startTS, startTS+1)
+	s.mustCommitOK(c, [][]byte{[]byte("y")}, newStartTS, newStartTS+1)
+	s.mustGetOK(c, "y", newStartTS+2, "y4")
+}
+
+func (s *testMockTiKVSuite) TestCheckTxnStatus(c *C) {
+	startTS := oracle.ComposeTS(100, 0)
+	errs := s.store.Prewrite(putMutations("pk", "val"), []byte("pk"), startTS, 50)
+	c.Assert(errs[0], IsNil)
+
+	// Locked, a normal lock has no minCommitTS to push, so it can still be
+	// committed before the caller's startTS.
+	ttl, commitTS, action, err := s.store.CheckTxnStatus([]byte("pk"), startTS, startTS+20, oracle.ComposeTS(110, 0))
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(40))
+	c.Assert(commitTS, Equals, uint64(0))
+	c.Assert(action, Equals, TxnActionNone)
+
+	// Locked by an async commit txn, the caller pushes minCommitTS.
+	errs = s.store.(*MvccStore).PrewriteAsyncCommit(putMutations("apk", "val"), []byte("apk"), startTS, 50, startTS+1, nil)
+	c.Assert(errs[0], IsNil)
+	// A caller without a startTS doesn't push minCommitTS.
+	_, _, action, err = s.store.CheckTxnStatus([]byte("apk"), startTS, 0, oracle.ComposeTS(110, 0))
+	c.Assert(err, IsNil)
+	c.Assert(action, Equals, TxnActionNone)
+	ttl, commitTS, action, err = s.store.CheckTxnStatus([]byte("apk"), startTS, startTS+1, oracle.ComposeTS(110, 0))
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(40))
+	c.Assert(commitTS, Equals, uint64(0))
+	c.Assert(action, Equals, TxnActionMinCommitTSPushed)
+	// Caller's startTS is already below minCommitTS, nothing to push.
+	_, _, action, err = s.store.CheckTxnStatus([]byte("apk"), startTS, startTS, oracle.ComposeTS(110, 0))
+	c.Assert(err, IsNil)
+	c.Assert(action, Equals, TxnActionNone)
+
+	// Committed.
+	s.mustCommitOK(c, [][]byte{[]byte("pk")}, startTS, startTS+10)
+	ttl, commitTS, action, err = s.store.CheckTxnStatus([]byte("pk"), startTS, startTS+20, oracle.ComposeTS(110, 0))
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(0))
+	c.Assert(commitTS, Equals, startTS+10)
+	c.Assert(action, Equals, TxnActionNone)
+
+	// Lock expired, rolled back.
+	startTS = oracle.ComposeTS(200, 0)
+	errs = s.store.Prewrite(putMutations("pk", "val"), []byte("pk"), startTS, 50)
+	c.Assert(errs[0], IsNil)
+	ttl, commitTS, action, err = s.store.CheckTxnStatus([]byte("pk"), startTS, startTS+1, oracle.ComposeTS(300, 0))
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(0))
+	c.Assert(commitTS, Equals, uint64(0))
+	c.Assert(action, Equals, TxnActionTTLExpireRollback)
+	s.mustCommitErr(c, [][]byte{[]byte("pk")}, startTS, startTS+1)
+	_, _, action, err = s.store.CheckTxnStatus([]byte("pk"), startTS, startTS+1, oracle.ComposeTS(300, 0))
+	c.Assert(err, IsNil)
+	c.Assert(action, Equals, TxnActionNone)
+
+	// Lock not exist, a rollback record is written.
+	startTS = oracle.ComposeTS(400, 0)
+	ttl, commitTS, action, err = s.store.CheckTxnStatus([]byte("pk"), startTS, startTS+1, oracle.ComposeTS(400, 1))
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(0))
+	c.Assert(commitTS, Equals, uint64(0))
+	c.Assert(action, Equals, TxnActionLockNotExistRollback)
+	errs = s.store.Prewrite(putMutations("pk", "val"), []byte("pk"), startTS, 50)
+	c.Assert(errs[0], NotNil)
+}
+
+func (s *testMockTiKVSuite) TestGetLockValue(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPrewriteOK(c, putMutations("pk", "pv", "sk", "sv"), "pk", 5)
+
+	val, ok, err := store.GetLockValue([]byte("sk"), 5)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	c.Assert(string(val), Equals, "sv")
+	_, ok, err = store.GetLockValue([]byte("sk"), 6)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	_, ok, err = store.GetLockValue([]byte("none"), 5)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+
+	s.mustCommitOK(c, [][]byte{[]byte("pk"), []byte("sk")}, 5, 10)
+	_, ok, err = store.GetLockValue([]byte("sk"), 5)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+}
+
+func (s *testMockTiKVSuite) TestGetBoundedStaleness(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "x", "x10", 5, 10)
+	s.mustPutOK(c, "x", "x20", 15, 20)
+	s.mustDeleteOK(c, "x", 25, 30)
+	s.mustPutOK(c, "x", "x40", 35, 40)
+	s.mustPrewriteOK(c, putMutations("x", "x50"), "x", 45)
+
+	cases := []struct {
+		minTS, maxTS uint64
+		value        string
+		commitTS     uint64
+	}{
+		{0, 9, "", 0},
+		{0, 10, "x10", 10},
+		{10, 19, "x10", 10},
+		{11, 19, "", 0},
+		{5, 25, "x20", 20},
+		{5, 35, "", 30},
+		{5, 100, "x40", 40},
+		{41, 100, "", 0},
+	}
+	for _, t := range cases {
+		val, commitTS, err := store.GetBoundedStaleness([]byte("x"), t.minTS, t.maxTS)
+		c.Assert(err, IsNil)
+		c.Assert(string(val), Equals, t.value)
+		c.Assert(commitTS, Equals, t.commitTS)
+	}
+}
+
+func (s *testMockTiKVSuite) TestPrewriteConflictDetail(c *C) {
+	s.mustPutOK(c, "x", "x10", 5, 10)
+	s.mustPrewriteOK(c, putMutations("y", "y15"), "y", 15)
+
+	errs := s.store.Prewrite(putMutations("x", "x8", "y", "y8", "z", "z8"), []byte("x"), 8, 0)
+	c.Assert(errs, HasLen, 3)
+	conflict, ok := errs[0].(*ErrWriteConflict)
+	c.Assert(ok, IsTrue)
+	c.Assert(conflict.Key.Raw(), BytesEquals, []byte("x"))
+	c.Assert(conflict.Primary, BytesEquals, []byte("x"))
+	c.Assert(conflict.StartTS, Equals, uint64(8))
+	c.Assert(conflict.ConflictStartTS, Equals, uint64(5))
+	c.Assert(conflict.ConflictTS, Equals, uint64(10))
+	locked, ok := errs[1].(*ErrLocked)
+	c.Assert(ok, IsTrue)
+	c.Assert(locked.Key.Raw(), BytesEquals, []byte("y"))
+	c.Assert(locked.StartTS, Equals, uint64(15))
+	c.Assert(errs[2], IsNil)
+}
+
+func (s *testMockTiKVSuite) TestWriteConflictTS(c *C) {
+	s.mustPutOK(c, "x", "x10", 5, 10)
+	s.mustPutOK(c, "x", "x20", 15, 20)
+
+	// The conflict is reported against the newest version.
+	errs := s.store.Prewrite(putMutations("x", "x12"), []byte("p"), 12, 0)
+	conflict, ok := errs[0].(*ErrWriteConflict)
+	c.Assert(ok, IsTrue)
+	c.Assert(conflict.ConflictStartTS, Equals, uint64(15))
+	c.Assert(conflict.ConflictTS, Equals, uint64(20))
+	c.Assert(conflict.Primary, BytesEquals, []byte("p"))
+
+	errs = s.store.PessimisticLock(lockMutations("x"), []byte("x"), 12, 18, 0)
+	conflict, ok = errs[0].(*ErrWriteConflict)
+	c.Assert(ok, IsTrue)
+	c.Assert(conflict.ConflictTS, Equals, uint64(20))
+}
+
+func (s *testMockTiKVSuite) TestRawKVIsolation(c *C) {
+	s.mustPutOK(c, "a", "mvcc-a", 5, 10)
+	s.store.RawPut([]byte("a"), []byte("raw-a"))
+	s.store.RawPut([]byte("b"), []byte("raw-b"))
+
+	c.Assert(s.store.RawGet([]byte("a")), BytesEquals, []byte("raw-a"))
+	s.mustGetOK(c, "a", 20, "mvcc-a")
+	s.mustGetNone(c, "b", 20)
+	s.mustScanOK(c, "", 10, 20, "a", "mvcc-a")
+
+	pairs := s.store.RawScan(nil, nil, 10)
+	c.Assert(pairs, HasLen, 2)
+	c.Assert(pairs[0].Key, BytesEquals, []byte("a"))
+	c.Assert(pairs[1].Key, BytesEquals, []byte("b"))
+
+	s.store.RawDelete([]byte("a"))
+	c.Assert(s.store.RawGet([]byte("a")), IsNil)
+	s.mustGetOK(c, "a", 20, "mvcc-a")
+	s.mustDeleteOK(c, "a", 25, 30)
+	c.Assert(s.store.RawGet([]byte("b")), BytesEquals, []byte("raw-b"))
+}
+
+func (s *testMockTiKVSuite) TestBatchGetAndLock(c *C) {
+	s.mustPutOK(c, "a", "a10", 5, 10)
+	s.mustPutOK(c, "b", "b10", 5, 10)
+	s.mustPrewriteOK(c, putMutations("c", "c15"), "c", 15)
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	pairs, errs := s.store.BatchGetAndLock(keys, []byte("a"), 20, 20, 0)
+	c.Assert(pairs, IsNil)
+	c.Assert(errs, HasLen, 4)
+	c.Assert(errs[0], IsNil)
+	c.Assert(errs[1], IsNil)
+	locked, ok := errs[2].(*ErrLocked)
+	c.Assert(ok, IsTrue)
+	c.Assert(locked.StartTS, Equals, uint64(15))
+	c.Assert(errs[3], IsNil)
+	// Locks acquired in the failed call are cleaned up.
+	s.mustScanLock(c, 100, []*kvrpcpb.LockInfo{lock("c", "c", 15)})
+
+	s.mustRollbackOK(c, [][]byte{[]byte("c")}, 15)
+	pairs, errs = s.store.BatchGetAndLock(keys, []byte("a"), 20, 25, 0)
+	for _, err := range errs {
+		c.Assert(err, IsNil)
+	}
+	c.Assert(pairs, HasLen, 2)
+	c.Assert(string(pairs[0].Value), Equals, "a10")
+	c.Assert(string(pairs[1].Value), Equals, "b10")
+	s.mustScanLock(c, 100, []*kvrpcpb.LockInfo{
+		lock("a", "a", 20),
+		lock("b", "a", 20),
+		lock("c", "a", 20),
+		lock("d", "a", 20),
+	})
+	// Other writers are blocked by the pessimistic locks.
+	errs = s.store.Prewrite(putMutations("a", "a30"), []byte("a"), 30, 0)
+	c.Assert(errs[0], NotNil)
+}
+
+func (s *testMockTiKVSuite) TestBatchGetAndLockWriteConflict(c *C) {
+	s.mustPutOK(c, "a", "a30", 25, 30)
+	_, errs := s.store.BatchGetAndLock([][]byte{[]byte("a")}, []byte("a"), 20, 20, 0)
+	conflict, ok := errs[0].(*ErrWriteConflict)
+	c.Assert(ok, IsTrue)
+	c.Assert(conflict.ConflictStartTS, Equals, uint64(25))
+	s.mustScanLock(c, 100, nil)
+}
+
+func (s *testMockTiKVSuite) TestApproximateSize(c *C) {
+	store := s.store.(*MvccStore)
+	size, err := store.ApproximateSize(nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, uint64(0))
+
+	value := strings.Repeat("v", 1000)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		s.mustPutOK(c, k, value, 5, 10)
+	}
+	s.mustPutOK(c, "b", value, 15, 20)
+
+	// 3 versions with 1000 bytes value in [b, d), plus the encoded keys.
+	size, err = store.ApproximateSize([]byte("b"), []byte("d"))
+	c.Assert(err, IsNil)
+	c.Assert(size >= 3000 && size <= 3100, IsTrue, Commentf("size: %d", size))
+	size, err = store.ApproximateSize([]byte("b"), []byte("b"))
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, uint64(0))
+	size, err = store.ApproximateSize(nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(size >= 5000 && size <= 5100, IsTrue, Commentf("size: %d", size))
+}
+
+func (s *testMockTiKVSuite) TestMvccGetByKey(c *C) {
+	c.Assert(s.store.MvccGetByKey([]byte("key")), IsNil)
+
+	s.mustPutOK(c, "key", "v1", 5, 10)
+	s.mustDeleteOK(c, "key", 15, 20)
+	s.mustPrewriteOK(c, putMutations("key", "v2"), "key", 25)
+	s.mustRollbackOK(c, [][]byte{[]byte("key")}, 25)
+	s.mustPrewriteOK(c, putMutations("key", "v3"), "key", 30)
+
+	info := s.store.MvccGetByKey([]byte("key"))
+	c.Assert(info, NotNil)
+	c.Assert(info.Lock, NotNil)
+	c.Assert(info.Lock.LockVersion, Equals, uint64(30))
+	c.Assert(info.Writes, HasLen, 3)
+	c.Assert(info.Writes[0].Type, Equals, kvrpcpb.Op_Rollback)
+	c.Assert(info.Writes[1].Type, Equals, kvrpcpb.Op_Del)
+	c.Assert(info.Writes[1].CommitTs, Equals, uint64(20))
+	c.Assert(info.Writes[2].Type, Equals, kvrpcpb.Op_Put)
+	c.Assert(string(info.Values[2].Value), Equals, "v1")
+
+	s.mustCommitOK(c, [][]byte{[]byte("key")}, 30, 35)
+	info = s.store.MvccGetByKey([]byte("key"))
+	c.Assert(info.Lock, IsNil)
+	c.Assert(info.Writes, HasLen, 4)
+}
+
+func (s *testMockTiKVSuite) TestLockSeq(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPrewriteOK(c, putMutations("a", "a0"), "a", 1)
+	_, seq := store.GetLock([]byte("a"))
+	c.Assert(seq, Equals, uint64(0))
+
+	store.EnableLockSeq(true)
+	s.mustPrewriteOK(c, putMutations("c", "c0"), "c", 5)
+	s.mustPrewriteOK(c, putMutations("b", "b0", "d", "d0"), "b", 3)
+	// Prewriting again doesn't change the sequence.
+	s.mustPrewriteOK(c, putMutations("c", "c0"), "c", 5)
+
+	var last uint64
+	for _, k := range []string{"c", "b", "d"} {
+		lock, seq := store.GetLock([]byte(k))
+		c.Assert(lock, NotNil)
+		c.Assert(seq > last, IsTrue)
+		last = seq
+	}
+	lock, _ := store.GetLock([]byte("e"))
+	c.Assert(lock, IsNil)
+}
+
+func (s *testMockTiKVSuite) TestMvccGetByStartTS(c *C) {
+	s.mustPutOK(c, "a", "a0", 1, 2)
+	s.mustPrewriteOK(c, putMutations("b", "b1", "c", "c1", "d", "d1"), "b", 5)
+
+	info, key := s.store.MvccGetByStartTS(nil, nil, 5)
+	c.Assert(info, NotNil)
+	c.Assert(MvccKey(key).Raw(), BytesEquals, []byte("b"))
+	c.Assert(info.Lock.LockVersion, Equals, uint64(5))
+
+	info, key = s.store.MvccGetByStartTS(NewMvccKey([]byte("c")), nil, 5)
+	c.Assert(info, NotNil)
+	c.Assert(MvccKey(key).Raw(), BytesEquals, []byte("c"))
+	info, key = s.store.MvccGetByStartTS(NewMvccKey([]byte("bb")), NewMvccKey([]byte("d")), 5)
+	c.Assert(MvccKey(key).Raw(), BytesEquals, []byte("c"))
+
+	// Committed values can be located too.
+	info, key = s.store.MvccGetByStartTS(nil, nil, 1)
+	c.Assert(info, NotNil)
+	c.Assert(MvccKey(key).Raw(), BytesEquals, []byte("a"))
+	c.Assert(info.Writes, HasLen, 1)
+
+	info, key = s.store.MvccGetByStartTS(nil, nil, 3)
+	c.Assert(info, IsNil)
+	c.Assert(key, IsNil)
+	info, _ = s.store.MvccGetByStartTS(NewMvccKey([]byte("e")), nil, 5)
+	c.Assert(info, IsNil)
+}
+
+func (s *testMockTiKVSuite) TestDeleteRange(c *C) {
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		s.mustPutOK(c, k, k+"1", 1, 2)
+		s.mustPutOK(c, k, k+"2", 3, 4)
+	}
+	s.mustPrewriteOK(c, putMutations("c", "c3"), "c", 5)
+	s.mustRollbackOK(c, [][]byte{[]byte("b")}, 6)
+
+	// The range covers locks and rollback records, and ends exactly at "d".
+	err := s.store.DeleteRange(NewMvccKey([]byte("b")), NewMvccKey([]byte("d")))
+	c.Assert(err, IsNil)
+	for _, k := range []string{"b", "c"} {
+		s.mustGetNone(c, k, 10)
+		c.Assert(s.store.MvccGetByKey([]byte(k)), IsNil)
+	}
+	s.mustScanLock(c, 10, nil)
+	s.mustGetOK(c, "a", 10, "a2")
+	s.mustGetOK(c, "d", 10, "d2")
+	s.mustGetOK(c, "e", 10, "e2")
+	c.Assert(s.store.MvccGetByKey([]byte("d")).Writes, HasLen, 2)
+
+	// The keys can be written again.
+	s.mustPutOK(c, "c", "c4", 11, 12)
+	s.mustGetOK(c, "c", 12, "c4")
+}
+
+func lockMutations(keys ...string) []*kvrpcpb.Mutation {
+	var mutations []*kvrpcpb.Mutation
+	for _, k := range keys {
+		mutations = append(mutations, &kvrpcpb.Mutation{
+			Op:  kvrpcpb.Op_Lock,
+			Key: []byte(k),
+		})
+	}
+	return mutations
+}
+
+func (s *testMockTiKVSuite) mustPessimisticLockOK(c *C, keys []string, primary string, startTS, forUpdateTS uint64) {
+	errs := s.store.PessimisticLock(lockMutations(keys...), []byte(primary), startTS, forUpdateTS, 0)
+	for _, err := range errs {
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *testMockTiKVSuite) TestPessimisticLock(c *C) {
+	s.mustPutOK(c, "a", "a0", 1, 2)
+	s.mustPessimisticLockOK(c, []string{"a", "b"}, "a", 5, 5)
+	s.mustScanLock(c, 10, []*kvrpcpb.LockInfo{
+		lock("a", "a", 5),
+		lock("b", "a", 5),
+	})
+
+	// Pessimistic locks block other txns.
+	errs := s.store.PessimisticLock(lockMutations("b"), []byte("b"), 6, 6, 0)
+	c.Assert(errs[0], NotNil)
+	errs = s.store.Prewrite(putMutations("a", "a6"), []byte("a"), 6, 0)
+	c.Assert(errs[0], NotNil)
+	// But not readers.
+	s.mustGetOK(c, "a", 10, "a0")
+
+	// A version committed after startTS but before forUpdateTS doesn't
+	// conflict with the later prewrite of the txn.
+	s.mustPutOK(c, "c", "c0", 6, 7)
+	s.mustPessimisticLockOK(c, []string{"c"}, "a", 5, 8)
+	s.mustPrewriteOK(c, putMutations("a", "a1", "b", "b1", "c", "c1"), "a", 5)
+	s.mustCommitOK(c, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, 5, 9)
+	s.mustGetOK(c, "a", 10, "a1")
+	s.mustGetOK(c, "b", 10, "b1")
+	s.mustGetOK(c, "c", 10, "c1")
+
+	// Locking a key prewritten by the txn keeps the prewrite lock.
+	s.mustPrewriteOK(c, putMutations("d", "d1"), "d", 20)
+	s.mustPessimisticLockOK(c, []string{"d"}, "d", 20, 25)
+	s.mustGetErr(c, "d", 30)
+	c.Assert(s.store.PessimisticRollback([][]byte{[]byte("d")}, 20, 25), IsNil)
+	s.mustScanLock(c, 30, []*kvrpcpb.LockInfo{lock("d", "d", 20)})
+	s.mustCommitOK(c, [][]byte{[]byte("d")}, 20, 26)
+	s.mustGetOK(c, "d", 30, "d1")
+}
+
+func (s *testMockTiKVSuite) TestPessimisticLockConflict(c *C) {
+	s.mustPutOK(c, "a", "a0", 1, 10)
+	// A version is committed after forUpdateTS.
+	errs := s.store.PessimisticLock(lockMutations("a"), []byte("a"), 5, 5, 0)
+	c.Assert(errs[0], NotNil)
+	s.mustScanLock(c, 20, nil)
+
+	// The lock is held by another txn.
+	s.mustPrewriteOK(c, putMutations("b", "b1"), "b", 15)
+	errs = s.store.PessimisticLock(lockMutations("b"), []byte("b"), 16, 16, 0)
+	_, ok := errs[0].(*ErrLocked)
+	c.Assert(ok, IsTrue)
+}
+
+func (s *testMockTiKVSuite) TestPessimisticRollback(c *C) {
+	s.mustPessimisticLockOK(c, []string{"a", "b"}, "a", 5, 6)
+	// A stale forUpdateTS doesn't remove the locks.
+	c.Assert(s.store.PessimisticRollback([][]byte{[]byte("a")}, 5, 5), IsNil)
+	c.Assert(s.store.PessimisticRollback([][]byte{[]byte("a")}, 4, 6), IsNil)
+	s.mustScanLock(c, 10, []*kvrpcpb.LockInfo{
+		lock("a", "a", 5),
+		lock("b", "a", 5),
+	})
+
+	c.Assert(s.store.PessimisticRollback([][]byte{[]byte("a"), []byte("b"), []byte("c")}, 5, 6), IsNil)
+	s.mustScanLock(c, 10, nil)
+	// No rollback record is left, so the txn can lock the keys again.
+	c.Assert(s.store.MvccGetByKey([]byte("a")).Writes, HasLen, 0)
+	c.Assert(s.store.MvccGetByKey([]byte("c")), IsNil)
+	s.mustPessimisticLockOK(c, []string{"a"}, "a", 5, 7)
+	s.mustPrewriteOK(c, putMutations("a", "a1"), "a", 5)
+	s.mustCommitOK(c, [][]byte{[]byte("a")}, 5, 8)
+	s.mustGetOK(c, "a", 10, "a1")
+}
+
+func (s *testMockTiKVSuite) TestScanLockLimit(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPrewriteOK(c, putMutations("a", "a1", "b", "b1", "c", "c1"), "a", 5)
+	s.mustPrewriteOK(c, putMutations("d", "d1", "e", "e1"), "d", 15)
+	s.mustPrewriteOK(c, putMutations("f", "f1", "g", "g1"), "f", 6)
+
+	// Locks newer than maxTS are skipped.
+	var (
+		keys     []string
+		startKey []byte
+	)
+	for i := 0; ; i++ {
+		c.Assert(i < 5, IsTrue)
+		locks, nextKey, err := store.ScanLockLimit(startKey, nil, 10, 2)
+		c.Assert(err, IsNil)
+		c.Assert(len(locks) <= 2, IsTrue)
+		for _, l := range locks {
+			keys = append(keys, string(l.Key))
+		}
+		if nextKey == nil {
+			break
+		}
+		startKey = nextKey
+	}
+	c.Assert(keys, DeepEquals, []string{"a", "b", "c", "f", "g"})
+
+	locks, nextKey, err := store.ScanLockLimit(nil, nil, 20, 0)
+	c.Assert(err, IsNil)
+	c.Assert(locks, HasLen, 7)
+	c.Assert(nextKey, IsNil)
+	locks, nextKey, err = store.ScanLockLimit(nil, NewMvccKey([]byte("c")), 20, 2)
+	c.Assert(err, IsNil)
+	c.Assert(locks, HasLen, 2)
+	c.Assert(nextKey, IsNil)
+}
+
+func (s *testMockTiKVSuite) TestBatchResolveLock(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPrewriteOK(c, putMutations("a", "a1", "b", "b1"), "a", 5)
+	s.mustPrewriteOK(c, putMutations("c", "c1"), "c", 6)
+	s.mustPrewriteOK(c, putMutations("d", "d1", "e", "e1"), "d", 7)
+	s.mustPrewriteOK(c, putMutations("f", "f1"), "f", 8)
+
+	err := store.BatchResolveLock(nil, nil, map[uint64]uint64{
+		5: 10,
+		6: 0,
+		7: 11,
+		9: 12,
+	})
+	c.Assert(err, IsNil)
+	s.mustScanLock(c, 20, []*kvrpcpb.LockInfo{
+		lock("f", "f", 8),
+	})
+	s.mustGetOK(c, "a", 20, "a1")
+	s.mustGetOK(c, "b", 20, "b1")
+	s.mustGetNone(c, "c", 20)
+	s.mustGetOK(c, "d", 20, "d1")
+	s.mustGetOK(c, "e", 20, "e1")
+	// The rolled back txn can't be committed any more.
+	s.mustCommitErr(c, [][]byte{[]byte("c")}, 6, 13)
+}
+
+func (s *testMockTiKVSuite) TestCommitRetry(c *C) {
+	s.mustPrewriteOK(c, putMutations("x", "x1"), "x", 5)
+	s.mustCommitOK(c, [][]byte{[]byte("x")}, 5, 10)
+	// Retrying with the same commitTS is idempotent.
+	s.mustCommitOK(c, [][]byte{[]byte("x")}, 5, 10)
+
+	err := s.store.Commit([][]byte{[]byte("x")}, 5, 11)
+	mismatch, ok := err.(*ErrCommitTSMismatch)
+	c.Assert(ok, IsTrue)
+	c.Assert(mismatch.ExistingCommitTS, Equals, uint64(10))
+	c.Assert(mismatch.CommitTS, Equals, uint64(11))
+	c.Assert(s.store.MvccGetByKey([]byte("x")).Writes, HasLen, 1)
+	s.mustGetOK(c, "x", 20, "x1")
+}
+
+func (s *testMockTiKVSuite) TestStats(c *C) {
+	store := s.store.(*MvccStore)
+	c.Assert(store.Stats(), DeepEquals, MvccStats{})
+
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPutOK(c, "a", "a2", 3, 4)
+	s.mustDeleteOK(c, "b", 5, 6)
+	s.mustRollbackOK(c, [][]byte{[]byte("c")}, 7)
+	s.mustPrewriteOK(c, putMutations("d", "d1", "e", "e1", "a", "a3"), "d", 8)
+
+	stats := store.Stats()
+	c.Assert(stats.Keys, Equals, 5)
+	c.Assert(stats.Locks, Equals, 3)
+	c.Assert(stats.Versions, Equals, 3)
+	c.Assert(stats.Rollbacks, Equals, 1)
+	c.Assert(stats.Size > 0, IsTrue)
+
+	s.mustCommitOK(c, [][]byte{[]byte("d"), []byte("e"), []byte("a")}, 8, 9)
+	stats = store.Stats()
+	c.Assert(stats.Locks, Equals, 0)
+	c.Assert(stats.Versions, Equals, 6)
+}
+
+func (s *testMockTiKVSuite) scanByCursor(startKey, endKey string, startTS uint64) []Pair {
+	cursor := s.store.(*MvccStore).ScanCursor([]byte(startKey), []byte(endKey), startTS, kvrpcpb.IsolationLevel_SI)
+	defer cursor.Close()
+	var pairs []Pair
+	for {
+		pair, ok := cursor.Next()
+		if !ok {
+			return pairs
+		}
+		pairs = append(pairs, pair)
+	}
+}
+
+func (s *testMockTiKVSuite) TestScanCursor(c *C) {
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPutOK(c, "b", "b1", 1, 2)
+	s.mustDeleteOK(c, "b", 3, 4)
+	s.mustPutOK(c, "c", "c1", 3, 4)
+	s.mustPutOK(c, "d", "d1", 5, 6)
+	s.mustPrewriteOK(c, putMutations("e", "e1"), "e", 7)
+	s.mustPutOK(c, "f", "f1", 1, 2)
+
+	for _, ts := range []uint64{3, 5, 10} {
+		for _, r := range [][2]string{{"", ""}, {"b", "e"}, {"c", "f"}, {"g", ""}} {
+			expect := s.store.Scan([]byte(r[0]), []byte(r[1]), 100, ts, kvrpcpb.IsolationLevel_SI)
+			c.Assert(s.scanByCursor(r[0], r[1], ts), DeepEquals, expect)
+		}
+	}
+	pairs := s.scanByCursor("", "", 10)
+	c.Assert(pairs, HasLen, 5)
+	c.Assert(pairs[3].Err, NotNil)
+
+	// Writes between calls are seen by the cursor.
+	cursor := s.store.(*MvccStore).ScanCursor(nil, nil, 10, kvrpcpb.IsolationLevel_SI)
+	pair, ok := cursor.Next()
+	c.Assert(ok, IsTrue)
+	c.Assert(string(pair.Key), Equals, "a")
+	s.mustPutOK(c, "aa", "aa1", 8, 9)
+	pair, ok = cursor.Next()
+	c.Assert(ok, IsTrue)
+	c.Assert(string(pair.Key), Equals, "aa")
+	cursor.Close()
+	_, ok = cursor.Next()
+	c.Assert(ok, IsFalse)
+}
+
+func (s *testMockTiKVSuite) TestBatchGetMany(c *C) {
+	// Write every third key in [0, 3000), delete some and lock some.
+	for i := 0; i < 3000; i += 3 {
+		k := fmt.Sprintf("k%04d", i)
+		s.mustPutOK(c, k, "v"+k, 1, 2)
+		switch i % 27 {
+		case 0:
+			s.mustDeleteOK(c, k, 3, 4)
+		case 9:
+			s.mustPrewriteOK(c, putMutations(k, "x"), k, 5)
+		}
+	}
+
+	keys := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		// Dense at the beginning and sparse later, with some duplicates.
+		n := i
+		if i >= 500 {
+			n = rand.Intn(3000)
+		}
+		keys = append(keys, []byte(fmt.Sprintf("k%04d", n)))
+	}
+	keys = append(keys, []byte("a"), []byte("z"), keys[0])
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	var expect []Pair
+	for _, k := range keys {
+		val, err := s.store.Get(k, 10, kvrpcpb.IsolationLevel_SI)
+		if val != nil || err != nil {
+			expect = append(expect, Pair{Key: k, Value: val, Err: err})
+		}
+	}
+	c.Assert(s.store.BatchGet(keys, 10, kvrpcpb.IsolationLevel_SI), DeepEquals, expect)
+	c.Assert(s.store.BatchGet(nil, 10, kvrpcpb.IsolationLevel_SI), HasLen, 0)
+}
+
+func (s *testMockTiKVSuite) BenchmarkBatchGet(c *C) {
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("k%04d", i)
+		s.mustPutOK(c, k, k, 1, 2)
+		keys = append(keys, []byte(k))
+	}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		s.store.BatchGet(keys, 10, kvrpcpb.IsolationLevel_SI)
+	}
+}
+
+func (s *testMockTiKVSuite) TestApplyEvents(c *C) {
+	store := s.store.(*MvccStore)
+	keys := func(ks ...string) [][]byte {
+		var res [][]byte
+		for _, k := range ks {
+			res = append(res, []byte(k))
+		}
+		return res
+	}
+	// txn1 and txn2 interleave on different keys, txn3 overwrites txn1 and is
+	// rolled back, txn4 is left prewritten.
+	err := store.ApplyEvents([]MvccEvent{
+		{Type: EventPrewrite, Mutations: putMutations("a", "a1", "b", "b1"), Primary: []byte("a"), StartTS: 1},
+		{Type: EventPrewrite, Mutations: putMutations("c", "c2"), Primary: []byte("c"), StartTS: 2},
+		{Type: EventCommit, Keys: keys("c"), StartTS: 2, CommitTS: 3},
+		{Type: EventCommit, Keys: keys("a", "b"), StartTS: 1, CommitTS: 4},
+		{Type: EventPrewrite, Mutations: putMutations("a", "a3"), Primary: []byte("a"), StartTS: 5},
+		{Type: EventRollback, Keys: keys("a"), StartTS: 5},
+		{Type: EventPrewrite, Mutations: putMutations("d", "d4"), Primary: []byte("d"), StartTS: 6},
+	})
+	c.Assert(err, IsNil)
+	s.mustGetOK(c, "a", 10, "a1")
+	s.mustGetOK(c, "b", 10, "b1")
+	s.mustGetOK(c, "c", 10, "c2")
+	s.mustGetNone(c, "b", 3)
+	s.mustScanLock(c, 10, []*kvrpcpb.LockInfo{lock("d", "d", 6)})
+
+	// Nothing is applied if an event fails.
+	err = store.ApplyEvents([]MvccEvent{
+		{Type: EventPrewrite, Mutations: putMutations("e", "e7"), Primary: []byte("e"), StartTS: 7},
+		{Type: EventPrewrite, Mutations: putMutations("a", "a8"), Primary: []byte("a"), StartTS: 2},
+		{Type: EventCommit, Keys: keys("e"), StartTS: 7, CommitTS: 8},
+	})
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "apply event 1"), IsTrue)
+	s.mustGetNone(c, "e", 10)
+	s.mustScanLock(c, 10, []*kvrpcpb.LockInfo{lock("d", "d", 6)})
+}
+
+func (s *testMockTiKVSuite) TestGetWithLockInfo(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	errs := store.Prewrite(putMutations("a", "a2", "b", "b2"), []byte("b"), 5, 100)
+	c.Assert(errs, DeepEquals, []error{nil, nil})
+
+	val, lockInfo, err := store.GetWithLockInfo([]byte("a"), 4)
+	c.Assert(err, IsNil)
+	c.Assert(lockInfo, IsNil)
+	c.Assert(string(val), Equals, "a1")
+	val, lockInfo, err = store.GetWithLockInfo([]byte("c"), 10)
+	c.Assert(err, IsNil)
+	c.Assert(lockInfo, IsNil)
+	c.Assert(val, IsNil)
+
+	val, lockInfo, err = store.GetWithLockInfo([]byte("a"), 10)
+	c.Assert(err, IsNil)
+	c.Assert(val, IsNil)
+	c.Assert(lockInfo, DeepEquals, &kvrpcpb.LockInfo{
+		Key:         []byte("a"),
+		PrimaryLock: []byte("b"),
+		LockVersion: 5,
+		LockTtl:     100,
+	})
+}
+
+func (s *testMockTiKVSuite) TestPrewriteAsyncCommit(c *C) {
+	store := s.store.(*MvccStore)
+	secondaries := [][]byte{[]byte("b"), []byte("c")}
+	errs := store.PrewriteAsyncCommit(putMutations("a", "a1", "b", "b1", "c", "c1"), []byte("a"), 5, 100, 6, secondaries)
+	c.Assert(errs, DeepEquals, []error{nil, nil, nil})
+
+	minCommitTS, keys, ok := store.AsyncCommitInfo([]byte("a"), 5)
+	c.Assert(ok, IsTrue)
+	c.Assert(minCommitTS, Equals, uint64(6))
+	c.Assert(keys, DeepEquals, secondaries)
+	// Secondary locks don't record the secondaries.
+	minCommitTS, keys, ok = store.AsyncCommitInfo([]byte("b"), 5)
+	c.Assert(ok, IsTrue)
+	c.Assert(minCommitTS, Equals, uint64(6))
+	c.Assert(keys, HasLen, 0)
+	_, _, ok = store.AsyncCommitInfo([]byte("a"), 4)
+	c.Assert(ok, IsFalse)
+
+	// The metadata is kept when CheckTxnStatus rewrites the entry, and
+	// minCommitTS can be pushed by it.
+	_, _, action, err := store.CheckTxnStatus([]byte("a"), 5, 10, 0)
+	c.Assert(err, IsNil)
+	c.Assert(action, Equals, TxnActionMinCommitTSPushed)
+	minCommitTS, keys, ok = store.AsyncCommitInfo([]byte("a"), 5)
+	c.Assert(ok, IsTrue)
+	c.Assert(minCommitTS, Equals, uint64(11))
+	c.Assert(keys, DeepEquals, secondaries)
+
+	// Normal prewrite doesn't use async commit.
+	s.mustPrewriteOK(c, putMutations("d", "d1"), "d", 7)
+	_, _, ok = store.AsyncCommitInfo([]byte("d"), 7)
+	c.Assert(ok, IsFalse)
+
+	s.mustCommitOK(c, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, 5, 12)
+	_, _, ok = store.AsyncCommitInfo([]byte("a"), 5)
+	c.Assert(ok, IsFalse)
+}
+
+func (s *testMockTiKVSuite) TestInvalidRange(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPrewriteOK(c, putMutations("b", "b1"), "b", 5)
+	store.RawPut([]byte("a"), []byte("a1"))
+	start, end := []byte("c"), []byte("a")
+	encStart, encEnd := NewMvccKey(start), NewMvccKey(end)
+
+	isRangeErr := func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "invalid range")
+	}
+	for _, pairs := range [][]Pair{
+		store.Scan(start, end, 10, 10, kvrpcpb.IsolationLevel_SI),
+		store.ReverseScan(start, end, 10, 10, kvrpcpb.IsolationLevel_SI),
+		store.RawScan(start, end, 10),
+	} {
+		c.Assert(pairs, HasLen, 1)
+		c.Assert(isRangeErr(pairs[0].Err), IsTrue)
+	}
+	_, err := store.ScanLock(encStart, encEnd, 10)
+	c.Assert(isRangeErr(err), IsTrue)
+	_, _, err = store.ScanLockLimit(encStart, encEnd, 10, 1)
+	c.Assert(isRangeErr(err), IsTrue)
+	c.Assert(isRangeErr(store.ResolveLock(encStart, encEnd, 5, 0)), IsTrue)
+	c.Assert(isRangeErr(store.BatchResolveLock(encStart, encEnd, map[uint64]uint64{5: 0})), IsTrue)
+	c.Assert(isRangeErr(store.DeleteRange(encStart, encEnd)), IsTrue)
+	_, err = store.ApproximateSize(start, end)
+	c.Assert(isRangeErr(err), IsTrue)
+
+	// Nothing is changed.
+	s.mustGetOK(c, "a", 10, "a1")
+	s.mustScanLock(c, 10, []*kvrpcpb.LockInfo{lock("b", "b", 5)})
+
+	// An empty endKey means no upper bound.
+	c.Assert(s.store.Scan(start, nil, 10, 10, kvrpcpb.IsolationLevel_SI), HasLen, 0)
+	_, err = store.ScanLock(encStart, nil, 10)
+	c.Assert(err, IsNil)
+}
+
+func (s *testMockTiKVSuite) TestExportImport(c *C) {
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPutOK(c, "a", "a2", 3, 4)
+	s.mustPutOK(c, "b", "b1", 1, 2)
+	s.mustDeleteOK(c, "b", 3, 4)
+	s.mustPutOK(c, "c", "c1", 5, 6)
+	s.mustPutOK(c, "e", "", 5, 6)
+	s.mustPrewriteOK(c, putMutations("d", "d1"), "d", 7)
+
+	store := s.store.(*MvccStore)
+	pairs, err := store.Export(5)
+	c.Assert(err, IsNil)
+	c.Assert(pairs, DeepEquals, []Pair{
+		{Key: []byte("a"), Value: []byte("a2")},
+	})
+	// "d" is locked.
+	_, err = store.Export(10)
+	c.Assert(err, NotNil)
+	s.mustCommitOK(c, [][]byte{[]byte("d")}, 7, 8)
+	pairs, err = store.Export(10)
+	c.Assert(err, IsNil)
+	c.Assert(pairs, HasLen, 4)
+	c.Assert(string(pairs[3].Key), Equals, "e")
+	c.Assert(pairs[3].Value, HasLen, 0)
+
+	other := NewMvccStore()
+	commitTS, err := other.Import(pairs)
+	c.Assert(err, IsNil)
+	exported, err := other.Export(commitTS)
+	c.Assert(err, IsNil)
+	c.Assert(exported, DeepEquals, pairs)
+	_, err = other.Export(commitTS - 1)
+	c.Assert(err, IsNil)
+
+	// Imported versions are newer than the existing ones.
+	commitTS, err = store.Import([]Pair{{Key: []byte("b"), Value: []byte("b2")}})
+	c.Assert(err, IsNil)
+	c.Assert(commitTS > 8, IsTrue)
+	s.mustGetOK(c, "b", commitTS, "b2")
+	s.mustGetNone(c, "b", commitTS-1)
+}
+
+func (s *testMockTiKVSuite) TestOracle(c *C) {
+	store := s.store.(*MvccStore)
+	_, err := store.GetTimestamp()
+	c.Assert(err, NotNil)
+
+	store.SetOracle(oracles.NewLocalOracle())
+	var last uint64
+	for i := 0; i < 100; i++ {
+		ts, err := store.GetTimestamp()
+		c.Assert(err, IsNil)
+		c.Assert(ts > last, IsTrue)
+		last = ts
+	}
+
+	startTS, err := store.GetTimestamp()
+	c.Assert(err, IsNil)
+	s.mustPrewriteOK(c, putMutations("a", "a1"), "a", startTS)
+	err = store.Commit([][]byte{[]byte("a")}, startTS, startTS)
+	_, ok := err.(*ErrInvalidCommitTS)
+	c.Assert(ok, IsTrue)
+	err = store.Commit([][]byte{[]byte("a")}, startTS, startTS-1)
+	_, ok = err.(*ErrInvalidCommitTS)
+	c.Assert(ok, IsTrue)
+
+	commitTS, err := store.GetTimestamp()
+	c.Assert(err, IsNil)
+	s.mustCommitOK(c, [][]byte{[]byte("a")}, startTS, commitTS)
+	s.mustGetOK(c, "a", commitTS, "a1")
+}
+
+func (s *testMockTiKVSuite) TestCommitTSNotGreaterThanStartTS(c *C) {
+	s.mustPrewriteOK(c, putMutations("a", "a1", "b", "b1"), "a", 5)
+	for _, commitTS := range []uint64{5, 4} {
+		err := s.store.Commit([][]byte{[]byte("a"), []byte("b")}, 5, commitTS)
+		_, ok := err.(*ErrInvalidCommitTS)
+		c.Assert(ok, IsTrue)
+		c.Assert(s.store.ResolveLock(nil, nil, 5, commitTS), NotNil)
+	}
+	// The locks are intact and can be committed later.
+	s.mustScanLock(c, 10, []*kvrpcpb.LockInfo{
+		lock("a", "a", 5),
+		lock("b", "a", 5),
+	})
+	s.mustCommitOK(c, [][]byte{[]byte("a"), []byte("b")}, 5, 6)
+	s.mustGetOK(c, "a", 6, "a1")
+}
+
+func (s *testMockTiKVSuite) TestScanKeys(c *C) {
+	store := s.store.(*MvccStore)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		s.mustPutOK(c, k, k+"1", 1, 2)
+	}
+	s.mustDeleteOK(c, "b", 3, 4)
+	s.mustPutOK(c, "f", "f1", 5, 6)
+
+	for _, ts := range []uint64{1, 3, 5, 10} {
+		for _, limit := range []int{2, 10} {
+			var expect [][]byte
+			for _, p := range s.store.Scan(nil, nil, limit, ts, kvrpcpb.IsolationLevel_SI) {
+				expect = append(expect, p.Key)
+			}
+			keys, err := store.ScanKeys(nil, nil, limit, ts, kvrpcpb.IsolationLevel_SI)
+			c.Assert(err, IsNil)
+			c.Assert(keys, DeepEquals, expect)
+		}
+	}
+	keys, err := store.ScanKeys([]byte("b"), []byte("e"), 10, 10, kvrpcpb.IsolationLevel_SI)
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, [][]byte{[]byte("c"), []byte("d")})
+
+	s.mustPrewriteOK(c, putMutations("d", "d2"), "d", 7)
+	_, err = store.ScanKeys(nil, nil, 10, 10, kvrpcpb.IsolationLevel_SI)
+	_, ok := errors.Cause(err).(*ErrLocked)
+	c.Assert(ok, IsTrue)
+	// Keys before the lock don't meet it.
+	keys, err = store.ScanKeys(nil, nil, 2, 10, kvrpcpb.IsolationLevel_SI)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+	keys, err = store.ScanKeys(nil, nil, 10, 10, kvrpcpb.IsolationLevel_RC)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 5)
+}
+
+func (s *testMockTiKVSuite) mustReverseScanOK(c *C, end string, limit int, ts uint64, expect ...string) {
+	pairs := s.store.ReverseScan(nil, []byte(end), limit, ts, kvrpcpb.IsolationLevel_SI)
+	c.Assert(len(pairs)*2, Equals, len(expect))
+	for i := 0; i < len(pairs); i++ {
+		c.Assert(pairs[i].Err, IsNil)
+		c.Assert(pairs[i].Key, BytesEquals, []byte(expect[i*2]))
+		c.Assert(string(pairs[i].Value), Equals, expect[i*2+1])
+	}
+}
+
+func (s *testMockTiKVSuite) TestReverseScanVersions(c *C) {
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		s.mustPutOK(c, k, k+"1", 1, 2)
+	}
+	s.mustDeleteOK(c, "b", 3, 4)
+	s.mustPutOK(c, "c", "c2", 3, 4)
+	s.mustDeleteOK(c, "d", 5, 6)
+	s.mustPutOK(c, "d", "d3", 7, 8)
+
+	s.mustReverseScanOK(c, "", 10, 3, "e", "e1", "d", "d1", "c", "c1", "b", "b1", "a", "a1")
+	s.mustReverseScanOK(c, "", 10, 5, "e", "e1", "d", "d1", "c", "c2", "a", "a1")
+	s.mustReverseScanOK(c, "", 10, 7, "e", "e1", "c", "c2", "a", "a1")
+	s.mustReverseScanOK(c, "", 10, 9, "e", "e1", "d", "d3", "c", "c2", "a", "a1")
+	// The end key is exclusive.
+	s.mustReverseScanOK(c, "d", 10, 9, "c", "c2", "a", "a1")
+	s.mustReverseScanOK(c, "cc", 1, 9, "c", "c2")
+	s.mustReverseScanOK(c, "a", 10, 9)
+}
+
+type observedCommit struct {
+	key      string
+	value    string
+	commitTS uint64
+	opType   mvccValueType
+}
+
+func (s *testMockTiKVSuite) TestCommitObserver(c *C) {
+	store := s.store.(*MvccStore)
+	var events []observedCommit
+	store.SetCommitObserver(func(key []byte, value []byte, commitTS uint64, opType mvccValueType) {
+		events = append(events, observedCommit{string(key), string(value), commitTS, opType})
+	})
+
+	mutations := putMutations("a", "a1", "c", "c1")
+	mutations = append(mutations, &kvrpcpb.Mutation{Op: kvrpcpb.Op_Del, Key: []byte("b")})
+	mutations = append(mutations, lockMutations("d")...)
+	s.mustPrewriteOK(c, mutations, "a", 5)
+	s.mustCommitOK(c, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}, 5, 10)
+	c.Assert(events, DeepEquals, []observedCommit{
+		{"a", "a1", 10, typePut},
+		{"b", "", 10, typeDelete},
+		{"c", "c1", 10, typePut},
+	})
+
+	// Committing again doesn't write anything new.
+	events = nil
+	s.mustCommitOK(c, [][]byte{[]byte("a")}, 5, 10)
+	c.Assert(events, HasLen, 0)
+
+	// Resolving locks commits them too, rollbacks are not reported.
+	s.mustPrewriteOK(c, putMutations("e", "e1", "f", "f1"), "e", 15)
+	s.mustPrewriteOK(c, putMutations("g", "g1"), "g", 16)
+	s.mustResolveLock(c, 15, 20)
+	c.Assert(store.BatchResolveLock(nil, nil, map[uint64]uint64{16: 0}), IsNil)
+	c.Assert(events, DeepEquals, []observedCommit{
+		{"e", "e1", 20, typePut},
+		{"f", "f1", 20, typePut},
+	})
+
+	// So are the commits replayed by ApplyEvents.
+	events = nil
+	err := store.ApplyEvents([]MvccEvent{
+		{Type: EventPrewrite, Mutations: putMutations("i", "i1", "j", "j1"), Primary: []byte("i"), StartTS: 21},
+		{Type: EventCommit, Keys: [][]byte{[]byte("i"), []byte("j")}, StartTS: 21, CommitTS: 22},
+		{Type: EventPrewrite, Mutations: putMutations("i", "i2"), Primary: []byte("i"), StartTS: 23},
+		{Type: EventCommit, Keys: [][]byte{[]byte("i")}, StartTS: 23, CommitTS: 24},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(events, DeepEquals, []observedCommit{
+		{"i", "i1", 22, typePut},
+		{"j", "j1", 22, typePut},
+		{"i", "i2", 24, typePut},
+	})
+
+	events = nil
+	store.SetCommitObserver(nil)
+	s.mustPutOK(c, "h", "h1", 25, 30)
+	c.Assert(events, HasLen, 0)
+}
+
+func (s *testMockTiKVSuite) TestGCRange(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPutOK(c, "a", "a2", 3, 4)
+	s.mustPutOK(c, "a", "a3", 11, 12)
+	s.mustPutOK(c, "b", "b1", 1, 2)
+	s.mustDeleteOK(c, "b", 3, 4)
+	s.mustRollbackOK(c, [][]byte{[]byte("c")}, 5)
+	s.mustPutOK(c, "d", "d1", 1, 2)
+	s.mustPrewriteOK(c, putMutations("d", "d2"), "d", 6)
+
+	var reported []int
+	err := store.GCRange(goctx.Background(), nil, nil, 10, func(n int) { reported = append(reported, n) })
+	c.Assert(err, IsNil)
+	c.Assert(reported, DeepEquals, []int{4})
+	// The version after safePoint and the latest one before it are kept.
+	c.Assert(store.MvccGetByKey([]byte("a")).Writes, HasLen, 2)
+	s.mustGetOK(c, "a", 10, "a2")
+	s.mustGetOK(c, "a", 12, "a3")
+	// Deleted and rolled back keys are removed.
+	c.Assert(store.MvccGetByKey([]byte("b")), IsNil)
+	c.Assert(store.MvccGetByKey([]byte("c")), IsNil)
+	// Locks are kept.
+	s.mustScanLock(c, 10, []*kvrpcpb.LockInfo{lock("d", "d", 6)})
+	c.Assert(store.MvccGetByKey([]byte("d")).Writes, HasLen, 1)
+}
+
+func (s *testMockTiKVSuite) TestLastGCDeletions(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPutOK(c, "a", "a2", 3, 4)
+	s.mustRollbackOK(c, [][]byte{[]byte("a")}, 5)
+	s.mustPutOK(c, "a", "a3", 6, 7)
+	s.mustPutOK(c, "a", "a4", 11, 12)
+	s.mustPutOK(c, "b", "b1", 1, 2)
+	s.mustDeleteOK(c, "b", 3, 4)
+
+	// Nothing is recorded by default.
+	s.mustPutOK(c, "z", "z1", 1, 2)
+	s.mustPutOK(c, "z", "z2", 3, 4)
+	c.Assert(store.GCRange(goctx.Background(), []byte("z"), nil, 10, nil), IsNil)
+	c.Assert(store.MvccGetByKey([]byte("z")).Writes, HasLen, 1)
+	c.Assert(store.LastGCDeletions(), HasLen, 0)
+
+	store.SetGCDeletionLimit(100)
+	c.Assert(store.GCRange(goctx.Background(), nil, nil, 10, nil), IsNil)
+	c.Assert(store.LastGCDeletions(), DeepEquals, []DeletedVersion{
+		{Key: []byte("a"), StartTS: 5, CommitTS: 5},
+		{Key: []byte("a"), StartTS: 3, CommitTS: 4},
+		{Key: []byte("a"), StartTS: 1, CommitTS: 2},
+		{Key: []byte("b"), StartTS: 3, CommitTS: 4},
+		{Key: []byte("b"), StartTS: 1, CommitTS: 2},
+	})
+	s.mustGetOK(c, "a", 10, "a3")
+
+	// The recorded deletions are bounded, and replaced by the next GC.
+	s.mustPutOK(c, "c", "c1", 1, 2)
+	s.mustPutOK(c, "c", "c2", 3, 4)
+	s.mustDeleteOK(c, "c", 5, 6)
+	store.SetGCDeletionLimit(2)
+	c.Assert(store.GCRange(goctx.Background(), nil, nil, 20, nil), IsNil)
+	c.Assert(store.LastGCDeletions(), DeepEquals, []DeletedVersion{
+		{Key: []byte("a"), StartTS: 6, CommitTS: 7},
+		{Key: []byte("c"), StartTS: 5, CommitTS: 6},
+	})
+}
+
+func (s *testMockTiKVSuite) TestGCRangeCancel(c *C) {
+	store := s.store.(*MvccStore)
+	keys := make([]string, gcBatchSize+10)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%04d", i)
+		s.mustPutOK(c, keys[i], "v1", 1, 2)
+		s.mustPutOK(c, keys[i], "v2", 3, 4)
+	}
+
+	ctx, cancel := goctx.WithCancel(goctx.Background())
+	var reported []int
+	err := store.GCRange(ctx, nil, nil, 10, func(n int) {
+		reported = append(reported, n)
+		cancel()
+	})
+	c.Assert(errors.Cause(err), Equals, goctx.Canceled)
+	c.Assert(reported, DeepEquals, []int{gcBatchSize})
+	for i, k := range keys {
+		writes := store.MvccGetByKey([]byte(k)).Writes
+		if i < gcBatchSize {
+			c.Assert(writes, HasLen, 1)
+		} else {
+			c.Assert(writes, HasLen, 2)
+		}
+		s.mustGetOK(c, k, 10, "v2")
+	}
+
+	// GC can go on from the start.
+	reported = nil
+	err = store.GCRange(goctx.Background(), nil, nil, 10, func(n int) { reported = append(reported, n) })
+	c.Assert(err, IsNil)
+	c.Assert(reported, DeepEquals, []int{gcBatchSize, len(keys)})
+	for _, k := range keys {
+		c.Assert(store.MvccGetByKey([]byte(k)).Writes, HasLen, 1)
+	}
+}
+
+func (s *testMockTiKVSuite) mustLocked(c *C, err error, key, primary string, startTS, ttl uint64) {
+	locked, ok := errors.Cause(err).(*ErrLocked)
+	c.Assert(ok, IsTrue, Commentf("err: %v", err))
+	c.Assert(locked.Key.Raw(), BytesEquals, []byte(key))
+	c.Assert(locked.Primary, BytesEquals, []byte(primary))
+	c.Assert(locked.StartTS, Equals, startTS)
+	c.Assert(locked.TTL, Equals, ttl)
+}
+
+func (s *testMockTiKVSuite) TestErrLockedFields(c *C) {
+	errs := s.store.Prewrite(putMutations("a", "a1", "b", "b1"), []byte("a"), 5, 30)
+	c.Assert(errs, DeepEquals, []error{nil, nil})
+
+	_, err := s.store.Get([]byte("b"), 10, kvrpcpb.IsolationLevel_SI)
+	s.mustLocked(c, err, "b", "a", 5, 30)
+
+	pairs := s.store.BatchGet([][]byte{[]byte("a"), []byte("b")}, 10, kvrpcpb.IsolationLevel_SI)
+	c.Assert(pairs, HasLen, 2)
+	s.mustLocked(c, pairs[0].Err, "a", "a", 5, 30)
+	s.mustLocked(c, pairs[1].Err, "b", "a", 5, 30)
+
+	pairs = s.store.Scan(nil, nil, 10, 10, kvrpcpb.IsolationLevel_SI)
+	c.Assert(pairs, HasLen, 2)
+	s.mustLocked(c, pairs[0].Err, "a", "a", 5, 30)
+
+	errs = s.store.Prewrite(putMutations("b", "b2"), []byte("b"), 8, 0)
+	s.mustLocked(c, errs[0], "b", "a", 5, 30)
+}
+
+func (s *testMockTiKVSuite) TestTxnHeartBeat(c *C) {
+	errs := s.store.Prewrite(putMutations("pk", "v", "k", "v"), []byte("pk"), 5, 10)
+	c.Assert(errs, DeepEquals, []error{nil, nil})
+
+	ttl, err := s.store.TxnHeartBeat([]byte("pk"), 5, 30)
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(30))
+	_, err = s.store.Get([]byte("pk"), 10, kvrpcpb.IsolationLevel_SI)
+	s.mustLocked(c, err, "pk", "pk", 5, 30)
+	// The TTL is never shortened.
+	ttl, err = s.store.TxnHeartBeat([]byte("pk"), 5, 20)
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(30))
+	// Secondary locks are not touched.
+	_, err = s.store.Get([]byte("k"), 10, kvrpcpb.IsolationLevel_SI)
+	s.mustLocked(c, err, "k", "pk", 5, 10)
+
+	// The lock is gone or belongs to another txn.
+	_, err = s.store.TxnHeartBeat([]byte("pk"), 6, 50)
+	notFound, ok := err.(*ErrTxnNotFound)
+	c.Assert(ok, IsTrue)
+	c.Assert(notFound.StartTS, Equals, uint64(6))
+	c.Assert(notFound.PrimaryKey, BytesEquals, []byte("pk"))
+	s.mustCommitOK(c, [][]byte{[]byte("pk"), []byte("k")}, 5, 10)
+	_, err = s.store.TxnHeartBeat([]byte("pk"), 5, 50)
+	_, ok = err.(*ErrTxnNotFound)
+	c.Assert(ok, IsTrue)
+	_, err = s.store.TxnHeartBeat([]byte("none"), 5, 50)
+	_, ok = err.(*ErrTxnNotFound)
+	c.Assert(ok, IsTrue)
+}
+
+func (s *testMockTiKVSuite) TestBatchGetOrder(c *C) {
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPutOK(c, "c", "c1", 1, 2)
+	s.mustPutOK(c, "d", "d1", 1, 2)
+	s.mustDeleteOK(c, "d", 3, 4)
+	s.mustPutOK(c, "e", "e1", 1, 2)
+	keys := [][]byte{[]byte("e"), []byte("b"), []byte("a"), []byte("d"), []byte("c"), []byte("a")}
+
+	// BatchGet keeps the order of the keys, skipping keys not found.
+	pairs := s.store.BatchGet(keys, 10, kvrpcpb.IsolationLevel_SI)
+	c.Assert(pairs, DeepEquals, []Pair{
+		{Key: []byte("e"), Value: []byte("e1")},
+		{Key: []byte("a"), Value: []byte("a1")},
+		{Key: []byte("c"), Value: []byte("c1")},
+		{Key: []byte("a"), Value: []byte("a1")},
+	})
+
+	pairs = s.store.(*MvccStore).BatchGetSorted(keys, 10, kvrpcpb.IsolationLevel_SI)
+	c.Assert(pairs, DeepEquals, []Pair{
+		{Key: []byte("a"), Value: []byte("a1")},
+		{Key: []byte("a"), Value: []byte("a1")},
+		{Key: []byte("c"), Value: []byte("c1")},
+		{Key: []byte("e"), Value: []byte("e1")},
+	})
+}
+
+func (s *testMockTiKVSuite) TestResolveLockLite(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPrewriteOK(c, putMutations("p1", "v5", "s1", "v5", "s2", "v5"), "p1", 5)
+	s.mustPrewriteOK(c, putMutations("p2", "v10", "s3", "v10"), "p2", 10)
+
+	// Only the listed keys are resolved, keys of other txns are skipped.
+	c.Assert(store.ResolveLockLite([][]byte{[]byte("p1"), []byte("s1"), []byte("p2")}, 5, 20), IsNil)
+	s.mustGetOK(c, "p1", 20, "v5")
+	s.mustGetOK(c, "s1", 20, "v5")
+	s.mustScanLock(c, 30, []*kvrpcpb.LockInfo{
+		lock("p2", "p2", 10),
+		lock("s2", "p1", 5),
+		lock("s3", "p2", 10),
+	})
+
+	c.Assert(store.ResolveLockLite([][]byte{[]byte("s3"), []byte("none")}, 10, 0), IsNil)
+	s.mustGetNone(c, "s3", 30)
+	s.mustScanLock(c, 30, []*kvrpcpb.LockInfo{
+		lock("p2", "p2", 10),
+		lock("s2", "p1", 5),
+	})
+	// The rollback record is written like ResolveLock.
+	s.mustCommitErr(c, [][]byte{[]byte("s3")}, 10, 30)
+}
+
+func (s *testMockTiKVSuite) TestMetrics(c *C) {
+	RegisterMetrics()
+	RegisterMetrics()
+
+	sampleCount := func(label string) uint64 {
+		var m dto.Metric
+		err := mvccCmdHistogram.WithLabelValues(label).(prometheus.Histogram).Write(&m)
+		c.Assert(err, IsNil)
+		return m.GetHistogram().GetSampleCount()
+	}
+	labels := []string{"get", "scan", "prewrite", "commit", "rollback", "resolve_lock"}
+	before := make(map[string]uint64)
+	for _, l := range labels {
+		before[l] = sampleCount(l)
+	}
+
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustGetOK(c, "a", 10, "a1")
+	s.mustScanOK(c, "", 10, 10, "a", "a1")
+	s.mustPrewriteOK(c, putMutations("b", "b1"), "b", 5)
+	s.mustRollbackOK(c, [][]byte{[]byte("b")}, 5)
+	s.mustResolveLock(c, 5, 0)
+	for _, l := range labels {
+		c.Assert(sampleCount(l) > before[l], IsTrue, Commentf("label: %s", l))
+	}
+}
+
+func (s *testMockTiKVSuite) TestRollbackTwice(c *C) {
+	// The key is never prewritten.
+	s.mustRollbackOK(c, [][]byte{[]byte("a")}, 5)
+	s.mustRollbackOK(c, [][]byte{[]byte("a")}, 5)
+	writes := s.store.MvccGetByKey([]byte("a")).Writes
+	c.Assert(writes, HasLen, 1)
+	c.Assert(writes[0].Type, Equals, kvrpcpb.Op_Rollback)
+	c.Assert(writes[0].StartTs, Equals, uint64(5))
+
+	// The lock is rolled back.
+	s.mustPrewriteOK(c, putMutations("b", "b1"), "b", 10)
+	s.mustRollbackOK(c, [][]byte{[]byte("b")}, 10)
+	s.mustRollbackOK(c, [][]byte{[]byte("b")}, 10)
+	c.Assert(s.store.MvccGetByKey([]byte("b")).Writes, HasLen, 1)
+	c.Assert(s.store.Cleanup([]byte("b"), 10), IsNil)
+	c.Assert(s.store.MvccGetByKey([]byte("b")).Writes, HasLen, 1)
+}
+
+func (s *testMockTiKVSuite) TestCheckpointRestore(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPutOK(c, "a", "", 3, 4)
+	s.mustDeleteOK(c, "b", 5, 6)
+	s.mustRollbackOK(c, [][]byte{[]byte("c")}, 7)
+	s.mustPrewriteOK(c, putMutations("d", "d1"), "a", 8)
+	c.Assert(store.PrewriteAsyncCommit(putMutations("e", "e1"), []byte("e"), 9, 10, 11, [][]byte{[]byte("f")}), DeepEquals, []error{nil})
+	store.RawPut([]byte("r"), []byte("r1"))
+	store.RawPut([]byte("s"), nil)
+
+	blob, err := store.Checkpoint()
+	c.Assert(err, IsNil)
+	stats := store.Stats()
+	infos := make(map[string]*kvrpcpb.MvccInfo)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		infos[k] = store.MvccGetByKey([]byte(k))
+	}
+	// The serialization is stable.
+	again, err := store.Checkpoint()
+	c.Assert(err, IsNil)
+	c.Assert(again, BytesEquals, blob)
+
+	s.mustPutOK(c, "a", "a2", 20, 21)
+	s.mustCommitOK(c, [][]byte{[]byte("d")}, 8, 22)
+	s.mustPutOK(c, "x", "x1", 23, 24)
+	store.RawDelete([]byte("r"))
+
+	c.Assert(store.Restore(blob), IsNil)
+	c.Assert(store.Stats(), DeepEquals, stats)
+	for k, info := range infos {
+		c.Assert(store.MvccGetByKey([]byte(k)), DeepEquals, info)
+	}
+	c.Assert(store.MvccGetByKey([]byte("x")), IsNil)
+	s.mustGetOK(c, "a", 10, "")
+	s.mustGetOK(c, "a", 2, "a1")
+	s.mustScanLock(c, 20, []*kvrpcpb.LockInfo{lock("d", "a", 8), lock("e", "e", 9)})
+	minCommitTS, secondaries, ok := store.AsyncCommitInfo([]byte("e"), 9)
+	c.Assert(ok, IsTrue)
+	c.Assert(minCommitTS, Equals, uint64(11))
+	c.Assert(secondaries, DeepEquals, [][]byte{[]byte("f")})
+	c.Assert(store.RawGet([]byte("r")), BytesEquals, []byte("r1"))
+	c.Assert(store.RawGet([]byte("s")), DeepEquals, []byte{})
+	again, err = store.Checkpoint()
+	c.Assert(err, IsNil)
+	c.Assert(again, BytesEquals, blob)
+
+	// A broken blob doesn't change the store.
+	s.mustPutOK(c, "x", "x1", 23, 24)
+	c.Assert(store.Restore(blob[:len(blob)-1]), NotNil)
+	c.Assert(store.Restore(append(blob, 0)), NotNil)
+	s.mustGetOK(c, "x", 30, "x1")
+}
+
+func (s *testMockTiKVSuite) TestHasLock(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPrewriteOK(c, putMutations("b", "b1"), "b", 5)
+	s.mustPessimisticLockOK(c, []string{"c"}, "c", 6, 6)
+
+	for _, tt := range []struct {
+		key     string
+		locked  bool
+		startTS uint64
+	}{
+		{"a", false, 0},
+		{"b", true, 5},
+		{"c", true, 6},
+		{"none", false, 0},
+	} {
+		locked, startTS, err := store.HasLock([]byte(tt.key))
+		c.Assert(err, IsNil)
+		c.Assert(locked, Equals, tt.locked, Commentf("key: %s", tt.key))
+		c.Assert(startTS, Equals, tt.startTS)
+	}
+
+	s.mustCommitOK(c, [][]byte{[]byte("b")}, 5, 10)
+	locked, _, err := store.HasLock([]byte("b"))
+	c.Assert(err, IsNil)
+	c.Assert(locked, IsFalse)
+}
+
+func (s *testMockTiKVSuite) TestPrewriteBelowGCSafePoint(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	store.SetGCSafePoint(10)
+
+	errs := s.store.Prewrite(putMutations("a", "a2", "b", "b2"), []byte("a"), 5, 0)
+	c.Assert(errs, HasLen, 2)
+	for _, err := range errs {
+		c.Assert(err, Equals, ErrRetryable("startTS below GC safepoint"))
+	}
+	s.mustScanLock(c, 20, nil)
+
+	// Transactions starting at or after the safe point are not affected.
+	s.mustPrewriteOK(c, putMutations("a", "a3"), "a", 10)
+	s.mustCommitOK(c, [][]byte{[]byte("a")}, 10, 11)
+	s.mustGetOK(c, "a", 20, "a3")
+}
+
+func (s *testMockTiKVSuite) TestCheckConsistency(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPutOK(c, "a", "a2", 3, 4)
+	s.mustDeleteOK(c, "a", 5, 6)
+	s.mustRollbackOK(c, [][]byte{[]byte("a")}, 7)
+	s.mustPrewriteOK(c, putMutations("a", "a3"), "a", 8)
+	s.mustPessimisticLockOK(c, []string{"b"}, "b", 9, 9)
+	c.Assert(store.CheckConsistency(), IsNil)
+
+	// corrupt replaces the entry of key with the given versions and lock.
+	corrupt := func(key string, lock *mvccLock, values ...mvccValue) {
+		store.tree.ReplaceOrInsert(&mvccEntry{key: NewMvccKey([]byte(key)), values: values, lock: lock})
+	}
+	checkErr := func(substr string) {
+		err := store.CheckConsistency()
+		c.Assert(err, NotNil)
+		c.Assert(strings.Contains(err.Error(), substr), IsTrue, Commentf("err: %v", err))
+		c.Assert(strings.Contains(err.Error(), `"x"`), IsTrue, Commentf("err: %v", err))
+	}
+
+	corrupt("x", &mvccLock{startTS: 5, primary: []byte("x")}, mvccValue{valueType: typePut, startTS: 6, commitTS: 7})
+	checkErr("is locked at 5 but committed at 7")
+	// A newer rollback record is fine.
+	corrupt("x", &mvccLock{startTS: 5, primary: []byte("x")}, mvccValue{valueType: typeRollback, startTS: 7, commitTS: 7})
+	c.Assert(store.CheckConsistency(), IsNil)
+
+	corrupt("x", nil,
+		mvccValue{valueType: typePut, startTS: 1, commitTS: 2},
+		mvccValue{valueType: typePut, startTS: 3, commitTS: 4})
+	checkErr("out of order")
+	corrupt("x", nil,
+		mvccValue{valueType: typePut, startTS: 3, commitTS: 4},
+		mvccValue{valueType: typeDelete, startTS: 1, commitTS: 4})
+	checkErr("out of order")
+
+	corrupt("x", nil,
+		mvccValue{valueType: typeRollback, startTS: 3, commitTS: 3},
+		mvccValue{valueType: typePut, startTS: 1, commitTS: 2},
+		mvccValue{valueType: typeRollback, startTS: 1, commitTS: 1})
+	checkErr("txn 1 of key \"x\" is both committed and rolled back")
+}
+
+func (s *testMockTiKVSuite) TestScanPrefix(c *C) {
+	store := s.store.(*MvccStore)
+	for _, k := range []string{"a", "ab", "ab\x00", "ab\xff", "ab\xff\xff", "ac", "\xff", "\xff\xff", "\xff\xff\x00"} {
+		s.mustPutOK(c, k, "v", 1, 2)
+	}
+	keys := func(prefix string, limit int) []string {
+		var keys []string
+		for _, p := range store.ScanPrefix([]byte(prefix), limit, 10, kvrpcpb.IsolationLevel_SI) {
+			c.Assert(p.Err, IsNil)
+			keys = append(keys, string(p.Key))
+		}
+		return keys
+	}
+
+	c.Assert(keys("ab", 10), DeepEquals, []string{"ab", "ab\x00", "ab\xff", "ab\xff\xff"})
+	c.Assert(keys("ab", 2), DeepEquals, []string{"ab", "ab\x00"})
+	c.Assert(keys("ab\xff", 10), DeepEquals, []string{"ab\xff", "ab\xff\xff"})
+	c.Assert(keys("b", 10), IsNil)
+	// An all 0xff prefix scans to the end.
+	c.Assert(keys("\xff", 10), DeepEquals, []string{"\xff", "\xff\xff", "\xff\xff\x00"})
+	c.Assert(keys("\xff\xff", 10), DeepEquals, []string{"\xff\xff", "\xff\xff\x00"})
+	c.Assert(keys("", 100), HasLen, 9)
+
+	c.Assert(prefixEnd([]byte("ab")), BytesEquals, []byte("ac"))
+	c.Assert(prefixEnd([]byte("a\xff\xff")), BytesEquals, []byte("b"))
+	c.Assert(prefixEnd([]byte("\xff\xff")), IsNil)
+}
+
+func (s *testMockTiKVSuite) TestCommitBatch(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPrewriteOK(c, putMutations("a", "a1", "b", "b1"), "a", 5)
+	s.mustPrewriteOK(c, putMutations("c", "c1"), "c", 6)
+	s.mustPrewriteOK(c, putMutations("d", "d1", "e", "e1"), "d", 7)
+
+	errs := store.CommitBatch([]CommitReq{
+		{Keys: [][]byte{[]byte("a"), []byte("b")}, StartTS: 5, CommitTS: 10},
+		{Keys: [][]byte{[]byte("c")}, StartTS: 6, CommitTS: 11},
+		{Keys: [][]byte{[]byte("d"), []byte("e")}, StartTS: 7, CommitTS: 12},
+	})
+	c.Assert(errs, DeepEquals, []error{nil, nil, nil})
+	s.mustScanLock(c, 20, nil)
+	s.mustScanOK(c, "", 10, 20, "a", "a1", "b", "b1", "c", "c1", "d", "d1", "e", "e1")
+	s.mustGetNone(c, "c", 10)
+	s.mustGetOK(c, "c", 11, "c1")
+
+	// A failed request writes nothing, the others are committed.
+	s.mustPrewriteOK(c, putMutations("f", "f1"), "f", 15)
+	s.mustPrewriteOK(c, putMutations("g", "g1", "h", "h1"), "g", 16)
+	errs = store.CommitBatch([]CommitReq{
+		{Keys: [][]byte{[]byte("f")}, StartTS: 15, CommitTS: 20},
+		{Keys: [][]byte{[]byte("g"), []byte("x")}, StartTS: 16, CommitTS: 21},
+		{Keys: [][]byte{[]byte("a")}, StartTS: 5, CommitTS: 10},
+	})
+	c.Assert(errs[0], IsNil)
+	c.Assert(errs[1], NotNil)
+	c.Assert(errs[2], IsNil)
+	s.mustGetOK(c, "f", 30, "f1")
+	s.mustScanLock(c, 30, []*kvrpcpb.LockInfo{lock("g", "g", 16), lock("h", "g", 16)})
+}
+
+func (s *testMockTiKVSuite) TestMaxScanLimit(c *C) {
+	store := s.store.(*MvccStore)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		s.mustPutOK(c, k, k, 1, 2)
+	}
+	s.mustDeleteOK(c, "e", 3, 4)
+
+	// No cap by default.
+	s.mustScanOK(c, "", 100, 10, "a", "a", "b", "b", "c", "c", "d", "d")
+
+	store.SetMaxScanLimit(2)
+	pairs := s.store.Scan(nil, nil, 100, 10, kvrpcpb.IsolationLevel_SI)
+	c.Assert(pairs, DeepEquals, []Pair{
+		{Key: []byte("a"), Value: []byte("a")},
+		{Key: []byte("b"), Value: []byte("b")},
+		{Err: ErrScanLimitExceeded},
+	})
+	// Limits within the cap are not affected.
+	s.mustScanOK(c, "", 2, 10, "a", "a", "b", "b")
+	// Not truncated if no more Pairs are available.
+	s.mustScanOK(c, "c", 100, 10, "c", "c", "d", "d")
+
+	store.SetMaxScanLimit(0)
+	s.mustScanOK(c, "", 100, 10, "a", "a", "b", "b", "c", "c", "d", "d")
+}
+
+func (s *testMockTiKVSuite) TestScanResumable(c *C) {
+	store := s.store.(*MvccStore)
+	var expect []string
+	for i := 0; i < 10; i++ {
+		k := fmt.Sprintf("k%d", i)
+		s.mustPutOK(c, k, "v1", 1, 2)
+		s.mustPutOK(c, k, "v2", 3, 4)
+		expect = append(expect, k)
+	}
+	// Keys outside the range and deleted keys are not returned.
+	s.mustPutOK(c, "z", "z", 1, 2)
+	s.mustDeleteOK(c, "k5", 5, 6)
+	expect = append(expect[:5], expect[6:]...)
+
+	var keys []string
+	var pages int
+	startKey := []byte("k")
+	for startKey != nil {
+		var pairs []Pair
+		pairs, startKey = store.ScanResumable(startKey, []byte("l"), 3, 10, kvrpcpb.IsolationLevel_SI)
+		c.Assert(len(pairs) <= 3, IsTrue)
+		for _, p := range pairs {
+			c.Assert(p.Err, IsNil)
+			c.Assert(p.Value, BytesEquals, []byte("v2"))
+			keys = append(keys, string(p.Key))
+		}
+		pages++
+	}
+	c.Assert(keys, DeepEquals, expect)
+	c.Assert(pages, Equals, 3)
+}
+
+func (s *testMockTiKVSuite) TestPrewriteDryRun(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 5, 10)
+	s.mustPrewriteOK(c, putMutations("b", "b1"), "b", 15)
+	before, err := store.Checkpoint()
+	c.Assert(err, IsNil)
+
+	mutations := putMutations("a", "a2", "b", "b2", "c", "c2", "c", "c3")
+	errs := store.PrewriteDryRun(mutations, []byte("a"), 8)
+	c.Assert(errs, HasLen, 4)
+	_, ok := errs[0].(*ErrWriteConflict)
+	c.Assert(ok, IsTrue)
+	s.mustLocked(c, errs[1], "b", "b", 15, 0)
+	c.Assert(errs[2], IsNil)
+	c.Assert(errs[3], IsNil)
+	after, err := store.Checkpoint()
+	c.Assert(err, IsNil)
+	c.Assert(after, BytesEquals, before)
+
+	// The errors are the same as a real prewrite.
+	c.Assert(s.store.Prewrite(mutations, []byte("a"), 8, 0), DeepEquals, errs)
+}
+
+func (s *testMockTiKVSuite) TestReverseScanLock(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPrewriteOK(c, putMutations("b", "b1", "c", "c1"), "b", 5)
+	s.mustPrewriteOK(c, putMutations("d", "d1"), "d", 10)
+	s.mustPrewriteOK(c, putMutations("e", "e1", "f", "f1"), "e", 15)
+
+	reversed := func(locks []*kvrpcpb.LockInfo) []*kvrpcpb.LockInfo {
+		var r []*kvrpcpb.LockInfo
+		for i := len(locks) - 1; i >= 0; i-- {
+			r = append(r, locks[i])
+		}
+		return r
+	}
+	for _, tt := range []struct {
+		start, end string
+		maxTS      uint64
+	}{
+		{"", "", 20},
+		{"", "", 10},
+		{"c", "f", 20},
+		{"b", "e", 5},
+		{"x", "", 20},
+	} {
+		startKey, endKey := NewMvccKey([]byte(tt.start)), NewMvccKey([]byte(tt.end))
+		locks, err := s.store.ScanLock(startKey, endKey, tt.maxTS)
+		c.Assert(err, IsNil)
+		reverse, err := store.ReverseScanLock(startKey, endKey, tt.maxTS)
+		c.Assert(err, IsNil)
+		c.Assert(reverse, DeepEquals, reversed(locks), Commentf("%v", tt))
+	}
+
+	locks, err := store.ReverseScanLock(NewMvccKey([]byte("c")), NewMvccKey([]byte("f")), 20)
+	c.Assert(err, IsNil)
+	c.Assert(locks, DeepEquals, []*kvrpcpb.LockInfo{lock("e", "e", 15), lock("d", "d", 10), lock("c", "b", 5)})
+}
+
+func (s *testMockTiKVSuite) TestMaxVersionsPerKey(c *C) {
+	store := s.store.(*MvccStore)
+	store.SetMaxVersionsPerKey(2)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustRollbackOK(c, [][]byte{[]byte("a")}, 3)
+	s.mustPutOK(c, "a", "a2", 4, 5)
+
+	s.mustPrewriteOK(c, putMutations("b", "b1", "a", "a3"), "b", 6)
+	before, err := store.Checkpoint()
+	c.Assert(err, IsNil)
+	err = s.store.Commit([][]byte{[]byte("b"), []byte("a")}, 6, 7)
+	tooMany, ok := err.(*ErrTooManyVersions)
+	c.Assert(ok, IsTrue)
+	c.Assert(tooMany.Key, BytesEquals, []byte("a"))
+	c.Assert(tooMany.Limit, Equals, 2)
+	after, err := store.Checkpoint()
+	c.Assert(err, IsNil)
+	c.Assert(after, BytesEquals, before)
+
+	// Locking the key doesn't add a version.
+	s.mustRollbackOK(c, [][]byte{[]byte("b"), []byte("a")}, 6)
+	s.mustPrewriteOK(c, lockMutations("a"), "a", 8)
+	s.mustCommitOK(c, [][]byte{[]byte("a")}, 8, 9)
+
+	// It can be committed after GC.
+	s.mustPrewriteOK(c, putMutations("a", "a3"), "a", 10)
+	c.Assert(store.GCRange(goctx.Background(), nil, nil, 10, nil), IsNil)
+	s.mustCommitOK(c, [][]byte{[]byte("a")}, 10, 11)
+	s.mustGetOK(c, "a", 20, "a3")
+
+	// Resolving the lock commits through the same limit.
+	s.mustPrewriteOK(c, putMutations("a", "a4"), "a", 12)
+	err = store.ResolveLock(nil, nil, 12, 13)
+	_, ok = errors.Cause(err).(*ErrTooManyVersions)
+	c.Assert(ok, IsTrue)
+	s.mustGetOK(c, "a", 11, "a3")
+
+	store.SetMaxVersionsPerKey(0)
+	s.mustResolveLock(c, 12, 13)
+	s.mustGetOK(c, "a", 20, "a4")
+
+	// BulkLoad and Import are limited too, and write nothing on failure.
+	store.SetMaxVersionsPerKey(3)
+	err = store.BulkLoad([]Pair{{Key: []byte("c"), Value: []byte("c1")}, {Key: []byte("a"), Value: []byte("a5")}}, 15)
+	_, ok = err.(*ErrTooManyVersions)
+	c.Assert(ok, IsTrue)
+	s.mustGetNone(c, "c", 20)
+	_, err = store.Import([]Pair{{Key: []byte("c"), Value: []byte("c1")}, {Key: []byte("a"), Value: []byte("a5")}})
+	_, ok = errors.Cause(err).(*ErrTooManyVersions)
+	c.Assert(ok, IsTrue)
+	s.mustGetNone(c, "c", 20)
+
+	store.SetMaxVersionsPerKey(0)
+	for ts := uint64(20); ts < 30; ts += 2 {
+		s.mustPutOK(c, "a", "a", ts, ts+1)
+	}
+}
+
+func (s *testMockTiKVSuite) TestMaxValueSize(c *C) {
+	store := s.store.(*MvccStore)
+	store.SetMaxValueSize(4)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	before, err := store.Checkpoint()
+	c.Assert(err, IsNil)
+
+	// Rejected mutations don't change the store.
+	c.Assert(s.store.Prewrite(putMutations("a", "12345"), []byte("a"), 3, 0)[0], NotNil)
+	after, err := store.Checkpoint()
+	c.Assert(err, IsNil)
+	c.Assert(after, BytesEquals, before)
+
+	mutations := putMutations("a", "12345", "b", "1234")
+	dryRunErrs := store.PrewriteDryRun(mutations, []byte("b"), 5)
+	errs := s.store.Prewrite(mutations, []byte("b"), 5, 0)
+	c.Assert(errs, DeepEquals, dryRunErrs)
+	tooLarge, ok := errs[0].(*ErrValueTooLarge)
+	c.Assert(ok, IsTrue)
+	c.Assert(tooLarge.Key, BytesEquals, []byte("a"))
+	c.Assert(tooLarge.Size, Equals, 5)
+	c.Assert(tooLarge.Limit, Equals, 4)
+	c.Assert(errs[1], IsNil)
+	s.mustScanLock(c, 10, []*kvrpcpb.LockInfo{lock("b", "b", 5)})
+	s.mustRollbackOK(c, [][]byte{[]byte("b")}, 5)
+
+	store.SetMaxValueSize(0)
+	s.mustPutOK(c, "a", "12345", 10, 11)
+}
+
+func (s *testMockTiKVSuite) TestPrewritePrimaryCheck(c *C) {
+	store := s.store.(*MvccStore)
+	for _, primary := range [][]byte{nil, {}} {
+		errs := s.store.Prewrite(putMutations("a", "a1", "b", "b1"), primary, 5, 0)
+		c.Assert(errs, DeepEquals, []error{ErrAbort("empty primary key"), ErrAbort("empty primary key")})
+		c.Assert(store.PrewriteDryRun(putMutations("a", "a1"), primary, 5), DeepEquals, []error{ErrAbort("empty primary key")})
+	}
+	s.mustScanLock(c, 10, nil)
+
+	// The primary key doesn't have to be in the mutations by default.
+	s.mustPrewriteOK(c, putMutations("b", "b1"), "a", 5)
+
+	store.SetStrictPrimaryCheck(true)
+	errs := s.store.Prewrite(putMutations("c", "c1", "d", "d1"), []byte("x"), 6, 0)
+	c.Assert(errs, HasLen, 2)
+	for _, err := range errs {
+		c.Assert(err, Equals, ErrAbort(`primary key "x" is not in mutations`))
+	}
+	s.mustScanLock(c, 10, []*kvrpcpb.LockInfo{lock("b", "a", 5)})
+	s.mustPrewriteOK(c, putMutations("c", "c1", "d", "d1"), "d", 6)
+}
+
+func (s *testMockTiKVSuite) TestRollbackStatus(c *C) {
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPrewriteOK(c, putMutations("b", "b1"), "b", 5)
+
+	rollback := func(key string, startTS uint64) (rollbackStatus, error) {
+		entry := s.store.(*MvccStore).getOrNewEntry(NewMvccKey([]byte(key)))
+		return entry.rollback(startTS)
+	}
+	status, err := rollback("b", 5)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, rollbackLock)
+	status, err = rollback("a", 1)
+	c.Assert(err, Equals, ErrAlreadyCommitted(2))
+	c.Assert(status, Equals, rollbackAlreadyCommitted)
+	status, err = rollback("c", 7)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, rollbackNotPrewritten)
+
+	s.mustRollbackOK(c, [][]byte{[]byte("c")}, 7)
+	status, err = rollback("c", 7)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, rollbackAlreadyRolledBack)
+	c.Assert(status.String(), Equals, "already rolled back")
+}
+
+func (s *testMockTiKVSuite) TestRollbackRange(c *C) {
+	store := s.store.(*MvccStore)
+	var keys []string
+	var mutations []*kvrpcpb.Mutation
+	for i := 0; i < 10; i++ {
+		k := fmt.Sprintf("k%d", i)
+		keys = append(keys, k)
+		if i != 3 && i != 7 {
+			mutations = append(mutations, putMutations(k, "v")...)
+		}
+	}
+	s.mustPrewriteOK(c, mutations, "k0", 5)
+	s.mustPrewriteOK(c, putMutations("k3", "v", "k7", "v"), "k3", 6)
+	s.mustPrewriteOK(c, putMutations("z", "v"), "z", 5)
+
+	err := store.RollbackRange(NewMvccKey([]byte("k")), NewMvccKey([]byte("l")), 5)
+	c.Assert(err, IsNil)
+	s.mustScanLock(c, 10, []*kvrpcpb.LockInfo{lock("k3", "k3", 6), lock("k7", "k3", 6), lock("z", "z", 5)})
+	for _, k := range keys {
+		if k == "k3" || k == "k7" {
+			continue
+		}
+		writes := store.MvccGetByKey([]byte(k)).Writes
+		c.Assert(writes, HasLen, 1)
+		c.Assert(writes[0].Type, Equals, kvrpcpb.Op_Rollback)
+		c.Assert(writes[0].StartTs, Equals, uint64(5))
+	}
+	// The rolled back txn can't be committed.
+	s.mustCommitErr(c, [][]byte{[]byte("k0")}, 5, 10)
+}
+
+func (s *testMockTiKVSuite) TestCommitWithPrimary(c *C) {
+	store := s.store.(*MvccStore)
+	startTS := oracle.ComposeTS(100, 0)
+	s.mustPrewriteOK(c, putMutations("a", "a1", "pk", "pk1", "b", "b1"), "pk", startTS)
+	// Simulate that a secondary lock is lost, so committing it fails.
+	s.mustRollbackOK(c, [][]byte{[]byte("b")}, startTS)
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("pk")}
+	err := store.CommitWithPrimary([]byte("pk"), keys, startTS, startTS+10)
+	c.Assert(err, NotNil)
+	s.mustGetOK(c, "pk", startTS+10, "pk1")
+	ttl, commitTS, _, err := s.store.CheckTxnStatus([]byte("pk"), startTS, startTS+20, oracle.ComposeTS(200, 0))
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(0))
+	c.Assert(commitTS, Equals, startTS+10)
+	// The remaining lock can be resolved.
+	s.mustScanLock(c, startTS+20, []*kvrpcpb.LockInfo{lock("a", "pk", startTS)})
+	s.mustResolveLock(c, startTS, commitTS)
+	s.mustGetOK(c, "a", startTS+10, "a1")
+
+	// A failed primary commits nothing.
+	s.mustPrewriteOK(c, putMutations("pk", "pk2", "c", "c2"), "pk", startTS+30)
+	err = store.CommitWithPrimary([]byte("pk"), [][]byte{[]byte("c"), []byte("pk")}, startTS+29, startTS+40)
+	c.Assert(err, NotNil)
+	s.mustScanLock(c, startTS+40, []*kvrpcpb.LockInfo{lock("c", "pk", startTS+30), lock("pk", "pk", startTS+30)})
+}
+
+func (s *testMockTiKVSuite) TestBulkLoad(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	err := store.BulkLoad([]Pair{
+		{Key: []byte("a"), Value: []byte("a10")},
+		{Key: []byte("b"), Value: []byte("b10")},
+	}, 10)
+	c.Assert(err, IsNil)
+	s.mustGetOK(c, "a", 5, "a1")
+	s.mustGetOK(c, "a", 11, "a10")
+	s.mustGetOK(c, "b", 11, "b10")
+	s.mustGetNone(c, "b", 9)
+	s.mustScanOK(c, "", 10, 11, "a", "a10", "b", "b10")
+	// The loaded versions are committed like normal ones.
+	ttl, commitTS, _, err := s.store.CheckTxnStatus([]byte("b"), 9, 12, 12)
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(0))
+	c.Assert(commitTS, Equals, uint64(10))
+	s.mustWriteWriteConflict(c, s.store.Prewrite(putMutations("b", "b8"), []byte("b"), 8, 0), 0)
+
+	s.mustPrewriteOK(c, putMutations("c", "c20"), "c", 20)
+	err = store.BulkLoad([]Pair{{Key: []byte("d"), Value: []byte("d")}, {Key: []byte("c"), Value: []byte("c")}}, 30)
+	c.Assert(err, NotNil)
+	s.mustGetNone(c, "d", 31)
+
+	// A key can't be loaded at the commitTS of an existing version.
+	err = store.BulkLoad([]Pair{{Key: []byte("d"), Value: []byte("d")}, {Key: []byte("a"), Value: []byte("a2")}}, 2)
+	conflict, ok := err.(*ErrWriteConflict)
+	c.Assert(ok, IsTrue)
+	c.Assert(conflict.Key.Raw(), BytesEquals, []byte("a"))
+	c.Assert(conflict.ConflictStartTS, Equals, uint64(1))
+	c.Assert(conflict.ConflictTS, Equals, uint64(2))
+	s.mustGetOK(c, "a", 5, "a1")
+	s.mustGetNone(c, "d", 31)
+
+	// A key can't be loaded twice in one batch.
+	err = store.BulkLoad([]Pair{{Key: []byte("d"), Value: []byte("d1")}, {Key: []byte("d"), Value: []byte("d2")}}, 40)
+	_, ok = err.(ErrAbort)
+	c.Assert(ok, IsTrue)
+	s.mustGetNone(c, "d", 41)
+}
+
+func (s *testMockTiKVSuite) BenchmarkBulkLoad(c *C) {
+	store := s.store.(*MvccStore)
+	kvs := make([]Pair, 1000)
+	for i := range kvs {
+		k := []byte(fmt.Sprintf("k%04d", i))
+		kvs[i] = Pair{Key: k, Value: k}
+	}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		store.BulkLoad(kvs, uint64(i+1)*2)
+	}
+}
+
+func (s *testMockTiKVSuite) BenchmarkPrewriteCommit(c *C) {
+	mutations := make([]*kvrpcpb.Mutation, 1000)
+	keys := make([][]byte, 1000)
+	for i := range mutations {
+		k := []byte(fmt.Sprintf("k%04d", i))
+		mutations[i] = &kvrpcpb.Mutation{Op: kvrpcpb.Op_Put, Key: k, Value: k}
+		keys[i] = k
+	}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		startTS := uint64(i+1)*2 - 1
+		s.store.Prewrite(mutations, keys[0], startTS, 0)
+		s.store.Commit(keys, startTS, startTS+1)
+	}
+}
+
+func (s *testMockTiKVSuite) TestFailpoint(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+
+	errInjected := errors.New("injected")
+	store.SetFailpoint("get", func() error { return errInjected })
+	_, err := s.store.Get([]byte("a"), 3, kvrpcpb.IsolationLevel_SI)
+	c.Assert(err, Equals, errInjected)
+	store.SetFailpoint("get", nil)
+	s.mustGetOK(c, "a", 3, "a1")
+
+	// The failpoint fails the first prewrite only.
+	var calls int
+	store.SetFailpoint("prewrite", func() error {
+		calls++
+		if calls == 1 {
+			return ErrRetryable("injected")
+		}
+		return nil
+	})
+	errs := s.store.Prewrite(putMutations("a", "a5", "b", "b5"), []byte("a"), 5, 0)
+	c.Assert(errs, HasLen, 2)
+	for _, err := range errs {
+		c.Assert(err, Equals, ErrRetryable("injected"))
+	}
+	s.mustScanLock(c, 10, nil)
+	s.mustPrewriteOK(c, putMutations("a", "a5", "b", "b5"), "a", 5)
+	c.Assert(calls, Equals, 2)
+
+	store.SetFailpoint("commit", func() error { return errInjected })
+	s.mustCommitErr(c, [][]byte{[]byte("a"), []byte("b")}, 5, 6)
+	store.SetFailpoint("commit", nil)
+	s.mustCommitOK(c, [][]byte{[]byte("a"), []byte("b")}, 5, 6)
+	s.mustGetOK(c, "b", 7, "b5")
+}
+
+func (s *testMockTiKVSuite) TestGetWithVersion(c *C) {
+	store := s.store.(*MvccStore)
+	mustGetWithVersion := func(key string, ts uint64, value string, commitTS uint64) {
+		val, version, err := store.GetWithVersion([]byte(key), ts, kvrpcpb.IsolationLevel_SI)
+		c.Assert(err, IsNil)
+		if value == "" {
+			c.Assert(val, IsNil)
+		} else {
+			c.Assert(string(val), Equals, value)
+		}
+		c.Assert(version, Equals, commitTS)
+	}
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPutOK(c, "a", "a2", 3, 4)
+	s.mustPrewriteOK(c, putMutations("a", "a5"), "a", 5)
+	s.mustRollbackOK(c, [][]byte{[]byte("a")}, 5)
+	s.mustDeleteOK(c, "a", 6, 7)
+	s.mustPutOK(c, "a", "a8", 8, 9)
+
+	mustGetWithVersion("a", 1, "", 0)
+	mustGetWithVersion("a", 2, "a1", 2)
+	mustGetWithVersion("a", 3, "a1", 2)
+	mustGetWithVersion("a", 5, "a2", 4)
+	mustGetWithVersion("a", 6, "a2", 4)
+	mustGetWithVersion("a", 7, "", 0)
+	mustGetWithVersion("a", 10, "a8", 9)
+	mustGetWithVersion("b", 10, "", 0)
+
+	s.mustPrewriteOK(c, putMutations("a", "a10"), "a", 10)
+	_, _, err := store.GetWithVersion([]byte("a"), 11, kvrpcpb.IsolationLevel_SI)
+	s.mustLocked(c, err, "a", "a", 10, 0)
+	mustGetWithVersion("a", 9, "a8", 9)
+}
+
+func (s *testMockTiKVSuite) TestPrewriteReturnValues(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPutOK(c, "b", "b3", 3, 4)
+	s.mustDeleteOK(c, "b", 5, 6)
+	s.mustPrewriteOK(c, putMutations("d", "d7"), "d", 7)
+
+	mutations := putMutations("a", "a10", "b", "b10", "c", "c10", "d", "d10")
+	values, errs := store.PrewriteReturnValues(mutations, []byte("a"), 10, 0)
+	c.Assert(values, HasLen, 4)
+	c.Assert(values[0], BytesEquals, []byte("a1"))
+	c.Assert(values[1], IsNil)
+	c.Assert(values[2], IsNil)
+	c.Assert(values[3], IsNil)
+	c.Assert(errs[:3], DeepEquals, []error{nil, nil, nil})
+	s.mustLocked(c, errs[3], "d", "d", 7, 0)
+	s.mustScanLock(c, 10, []*kvrpcpb.LockInfo{
+		lock("a", "a", 10),
+		lock("b", "a", 10),
+		lock("c", "a", 10),
+		lock("d", "d", 7),
+	})
+}
+
+func (s *testMockTiKVSuite) TestScanLockByPrimary(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPrewriteOK(c, putMutations("a", "a1", "c", "c1", "e", "e1"), "a", 5)
+	s.mustPrewriteOK(c, putMutations("b", "b1", "d", "d1"), "d", 10)
+
+	locks, err := store.ScanLockByPrimary(nil, nil, 20, []byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(locks, DeepEquals, []*kvrpcpb.LockInfo{lock("a", "a", 5), lock("c", "a", 5), lock("e", "a", 5)})
+	locks, err = store.ScanLockByPrimary(nil, nil, 20, []byte("d"))
+	c.Assert(err, IsNil)
+	c.Assert(locks, DeepEquals, []*kvrpcpb.LockInfo{lock("b", "d", 10), lock("d", "d", 10)})
+	locks, err = store.ScanLockByPrimary(NewMvccKey([]byte("b")), NewMvccKey([]byte("e")), 20, []byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(locks, DeepEquals, []*kvrpcpb.LockInfo{lock("c", "a", 5)})
+	locks, err = store.ScanLockByPrimary(nil, nil, 8, []byte("d"))
+	c.Assert(err, IsNil)
+	c.Assert(locks, HasLen, 0)
+	locks, err = store.ScanLockByPrimary(nil, nil, 20, []byte("b"))
+	c.Assert(err, IsNil)
+	c.Assert(locks, HasLen, 0)
+}
+
+func (s *testMockTiKVSuite) TestForceUnlock(c *C) {
+	store := s.store.(*MvccStore)
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPrewriteOK(c, putMutations("a", "a5", "b", "b5"), "a", 5)
+	s.mustGetErr(c, "a", 10)
+	s.mustGetErr(c, "b", 10)
+
+	for _, key := range []string{"a", "b"} {
+		unlocked, err := store.ForceUnlock([]byte(key))
+		c.Assert(err, IsNil)
+		c.Assert(unlocked, IsTrue)
+	}
+	s.mustGetOK(c, "a", 10, "a1")
+	s.mustGetNone(c, "b", 10)
+	s.mustScanLock(c, 10, nil)
+
+	unlocked, err := store.ForceUnlock([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(unlocked, IsFalse)
+	unlocked, err = store.ForceUnlock([]byte("c"))
+	c.Assert(err, IsNil)
+	c.Assert(unlocked, IsFalse)
+	// The txn can't be committed after its locks are removed.
+	s.mustCommitErr(c, [][]byte{[]byte("a"), []byte("b")}, 5, 6)
+	s.mustGetOK(c, "a", 10, "a1")
+}
+
+func (s *testMockTiKVSuite) TestNextKey(c *C) {
+	for _, tt := range []struct {
+		key, next string
+	}{
+		{"", "\x00"},
+		{"a", "a\x00"},
+		{"a\x00", "a\x00\x00"},
+		{"a\xff", "a\xff\x00"},
+		{"\xff\xff", "\xff\xff\x00"},
+	} {
+		key := []byte(tt.key)
+		next := NextKey(key)
+		c.Assert(next, BytesEquals, []byte(tt.next))
+		c.Assert(bytes.Compare(key, next) < 0, IsTrue)
+		c.Assert(key, BytesEquals, []byte(tt.key))
+	}
+	// No key is between a key and its next key.
+	s.mustPutOK(c, "a", "a1", 1, 2)
+	s.mustPutOK(c, "a\x00", "a2", 1, 2)
+	s.mustPutOK(c, "a\x00\x00", "a3", 1, 2)
+	s.mustScanOK(c, "a", 10, 5, "a", "a1", "a\x00", "a2", "a\x00\x00", "a3")
+	pairs := s.store.Scan([]byte("a"), NextKey([]byte("a\x00")), 10, 5, kvrpcpb.IsolationLevel_SI)
+	c.Assert(pairs, HasLen, 2)
+}
+
+func (s *testMockTiKVSuite) TestCommitBelowMinCommitTS(c *C) {
+	store := s.store.(*MvccStore)
+	errs := store.PrewriteAsyncCommit(putMutations("a", "a1", "b", "b1"), []byte("a"), 5, 0, 10, [][]byte{[]byte("b")})
+	c.Assert(errs, DeepEquals, []error{nil, nil})
+
+	err := s.store.Commit([][]byte{[]byte("a"), []byte("b")}, 5, 9)
+	expired, ok := errors.Cause(err).(*ErrCommitTSExpired)
+	c.Assert(ok, IsTrue, Commentf("err: %v", err))
+	c.Assert(*expired, Equals, ErrCommitTSExpired{StartTS: 5, CommitTS: 9, MinCommitTS: 10})
+	s.mustScanLock(c, 20, []*kvrpcpb.LockInfo{lock("a", "a", 5), lock("b", "a", 5)})
+	s.mustGetNone(c, "a", 4)
+
+	s.mustCommitOK(c, [][]byte{[]byte("a"), []byte("b")}, 5, 10)
+	s.mustGetOK(c, "a", 10, "a1")
+	s.mustGetOK(c, "b", 10, "b1")
+	s.mustScanLock(c, 20, nil)
+
+	// Locks of normal txns have no minCommitTS.
+	s.mustPrewriteOK(c, putMutations("c", "c1"), "c", 20)
+	s.mustCommitOK(c, [][]byte{[]byte("c")}, 20, 21)
+}
@@ -15,13 +15,18 @@ package mocktikv
 
 import (
 	"bytes"
+	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/juju/errors"
+	"github.com/ngaut/log"
 	"github.com/petar/GoLLRB/llrb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/store/tikv/oracle"
 	"github.com/pingcap/tidb/util/codec"
+	goctx "golang.org/x/net/context"
 )
 
 type mvccValueType int
@@ -40,11 +45,46 @@ type mvccValue struct {
 }
 
 type mvccLock struct {
-	startTS uint64
-	primary []byte
-	value   []byte
-	op      kvrpcpb.Op
-	ttl     uint64
+	startTS     uint64
+	primary     []byte
+	value       []byte
+	op          kvrpcpb.Op
+	ttl         uint64
+	minCommitTS uint64
+	// forUpdateTS is set for pessimistic locks.
+	forUpdateTS uint64
+	// seq is the order in which the lock was acquired, 0 if lock sequencing
+	// is disabled.
+	seq uint64
+	// useAsyncCommit is set for locks prewritten by PrewriteAsyncCommit, the
+	// primary lock records all the secondary keys of the txn.
+	useAsyncCommit bool
+	secondaries    [][]byte
+}
+
+// isExpired returns whether the lock's TTL has elapsed at currentTS. TTL is in
+// milliseconds, the same unit as the physical part of a timestamp. A zero
+// currentTS means locks never expire.
+func (l *mvccLock) isExpired(currentTS uint64) bool {
+	if currentTS == 0 {
+		return false
+	}
+	return oracle.ExtractPhysical(currentTS) >= oracle.ExtractPhysical(l.startTS)+int64(l.ttl)
+}
+
+// remainingTTL returns the lock's TTL left at currentTS.
+func (l *mvccLock) remainingTTL(currentTS uint64) uint64 {
+	if currentTS == 0 {
+		return l.ttl
+	}
+	elapsed := oracle.ExtractPhysical(currentTS) - oracle.ExtractPhysical(l.startTS)
+	if elapsed <= 0 {
+		return l.ttl
+	}
+	if uint64(elapsed) >= l.ttl {
+		return 0
+	}
+	return l.ttl - uint64(elapsed)
 }
 
 type mvccEntry struct {
@@ -72,11 +112,19 @@ func (e *mvccEntry) Clone() *mvccEntry {
 	}
 	if e.lock != nil {
 		entry.lock = &mvccLock{
-			startTS: e.lock.startTS,
-			primary: append([]byte(nil), e.lock.primary...),
-			value:   append([]byte(nil), e.lock.value...),
-			op:      e.lock.op,
-			ttl:     e.lock.ttl,
+			startTS:     e.lock.startTS,
+			primary:     append([]byte(nil), e.lock.primary...),
+			value:       append([]byte(nil), e.lock.value...),
+			op:          e.lock.op,
+			ttl:         e.lock.ttl,
+			minCommitTS: e.lock.minCommitTS,
+			forUpdateTS: e.lock.forUpdateTS,
+			seq:         e.lock.seq,
+
+			useAsyncCommit: e.lock.useAsyncCommit,
+		}
+		for _, k := range e.lock.secondaries {
+			entry.lock.secondaries = append(entry.lock.secondaries, append([]byte(nil), k...))
 		}
 	}
 	return &entry
@@ -95,31 +143,81 @@ func (e *mvccEntry) lockErr() error {
 	}
 }
 
+// Get reads the value visible at ts. Under RC isolation locks are ignored and
+// the latest committed value is returned regardless of ts. Pessimistic locks
+// never block reads since they write nothing.
 func (e *mvccEntry) Get(ts uint64, isoLevel kvrpcpb.IsolationLevel) ([]byte, error) {
+	v, err := e.getVersion(ts, isoLevel)
+	if v == nil || err != nil {
+		return nil, err
+	}
+	return v.value, nil
+}
+
+// getVersion returns the version read by Get, which is nil if there isn't
+// any.
+func (e *mvccEntry) getVersion(ts uint64, isoLevel kvrpcpb.IsolationLevel) (*mvccValue, error) {
 	if isoLevel == kvrpcpb.IsolationLevel_SI {
-		if e.lock != nil && e.lock.startTS <= ts {
+		if e.lock != nil && e.lock.forUpdateTS == 0 && e.lock.startTS <= ts {
 			return nil, e.lockErr()
 		}
 	}
-	for _, v := range e.values {
-		if v.commitTS <= ts && v.valueType != typeRollback {
-			return v.value, nil
+	for i := range e.values {
+		v := &e.values[i]
+		if (isoLevel == kvrpcpb.IsolationLevel_RC || v.commitTS <= ts) && v.valueType != typeRollback {
+			return v, nil
 		}
 	}
 	return nil, nil
 }
 
+// getBoundedStaleness returns the newest committed version whose commitTS is
+// in [minTS, maxTS]. Locks are ignored.
+func (e *mvccEntry) getBoundedStaleness(minTS, maxTS uint64) *mvccValue {
+	for i := range e.values {
+		v := &e.values[i]
+		if v.commitTS < minTS {
+			return nil
+		}
+		if v.commitTS <= maxTS && v.valueType != typeRollback {
+			return v
+		}
+	}
+	return nil
+}
+
 func (e *mvccEntry) Prewrite(mutation *kvrpcpb.Mutation, startTS uint64, primary []byte, ttl uint64) error {
+	if e.lock != nil && e.lock.startTS == startTS && e.lock.forUpdateTS > 0 {
+		// Turn the txn's own pessimistic lock into a normal lock. No version
+		// can be committed after forUpdateTS while the pessimistic lock is
+		// held, so there is no need to check write conflicts.
+		e.lock = &mvccLock{
+			startTS: startTS,
+			primary: primary,
+			value:   mutation.Value,
+			op:      mutation.GetOp(),
+			ttl:     ttl,
+		}
+		return nil
+	}
 	if len(e.values) > 0 {
 		if e.values[0].commitTS >= startTS {
-			return ErrRetryable("write conflict")
+			return &ErrWriteConflict{
+				Key:             e.key,
+				Primary:         primary,
+				StartTS:         startTS,
+				ConflictStartTS: e.values[0].startTS,
+				ConflictTS:      e.values[0].commitTS,
+			}
 		}
 	}
 	if e.lock != nil {
-		if e.lock.startTS != startTS {
-			return e.lockErr()
+		if e.lock.startTS == startTS {
+			return nil
 		}
-		return nil
+		// Even if the lock is expired, its txn may be committed by the
+		// primary key already. The client resolves it by checking the primary.
+		return e.lockErr()
 	}
 	e.lock = &mvccLock{
 		startTS: startTS,
@@ -131,6 +229,52 @@ func (e *mvccEntry) Prewrite(mutation *kvrpcpb.Mutation, startTS uint64, primary
 	return nil
 }
 
+// PessimisticLock acquires a pessimistic lock on the entry. The lock blocks
+// other writers like a normal lock but commits nothing.
+func (e *mvccEntry) PessimisticLock(startTS, forUpdateTS uint64, primary []byte, ttl uint64) error {
+	if e.lock != nil {
+		if e.lock.startTS == startTS {
+			// A prewritten lock of the txn is kept as it is.
+			if e.lock.forUpdateTS > 0 && e.lock.forUpdateTS < forUpdateTS {
+				e.lock.forUpdateTS = forUpdateTS
+			}
+			return nil
+		}
+		return e.lockErr()
+	}
+	if len(e.values) > 0 {
+		if e.values[0].commitTS > forUpdateTS {
+			return &ErrWriteConflict{
+				Key:             e.key,
+				Primary:         primary,
+				StartTS:         startTS,
+				ConflictStartTS: e.values[0].startTS,
+				ConflictTS:      e.values[0].commitTS,
+			}
+		}
+	}
+	e.lock = &mvccLock{
+		startTS:     startTS,
+		primary:     primary,
+		op:          kvrpcpb.Op_Lock,
+		ttl:         ttl,
+		forUpdateTS: forUpdateTS,
+	}
+	return nil
+}
+
+// PessimisticRollback removes the pessimistic lock of the txn if its
+// forUpdateTS is not greater than forUpdateTS. Unlike Rollback, it leaves no
+// rollback record since the txn may lock the key again. It returns whether the
+// lock is removed.
+func (e *mvccEntry) PessimisticRollback(startTS, forUpdateTS uint64) bool {
+	if e.lock != nil && e.lock.startTS == startTS && e.lock.forUpdateTS > 0 && e.lock.forUpdateTS <= forUpdateTS {
+		e.lock = nil
+		return true
+	}
+	return false
+}
+
 func (e *mvccEntry) getTxnCommitInfo(startTS uint64) *mvccValue {
 	for _, v := range e.values {
 		if v.startTS == startTS {
@@ -140,14 +284,36 @@ func (e *mvccEntry) getTxnCommitInfo(startTS uint64) *mvccValue {
 	return nil
 }
 
-func (e *mvccEntry) Commit(startTS, commitTS uint64) error {
+// Commit commits the lock of startTS at commitTS. maxVersions limits the number
+// of committed versions of the key, 0 means no limit.
+func (e *mvccEntry) Commit(startTS, commitTS uint64, maxVersions int) error {
+	if commitTS <= startTS {
+		return &ErrInvalidCommitTS{StartTS: startTS, CommitTS: commitTS}
+	}
 	if e.lock == nil || e.lock.startTS != startTS {
 		if c := e.getTxnCommitInfo(startTS); c != nil && c.valueType != typeRollback {
+			if c.commitTS != commitTS {
+				return &ErrCommitTSMismatch{
+					StartTS:          startTS,
+					CommitTS:         commitTS,
+					ExistingCommitTS: c.commitTS,
+				}
+			}
 			return nil
 		}
 		return ErrRetryable("txn not found")
 	}
+	if commitTS < e.lock.minCommitTS {
+		return &ErrCommitTSExpired{
+			StartTS:     startTS,
+			CommitTS:    commitTS,
+			MinCommitTS: e.lock.minCommitTS,
+		}
+	}
 	if e.lock.op != kvrpcpb.Op_Lock {
+		if err := e.checkVersionCount(maxVersions); err != nil {
+			return err
+		}
 		var valueType mvccValueType
 		if e.lock.op == kvrpcpb.Op_Put {
 			valueType = typePut
@@ -165,7 +331,61 @@ func (e *mvccEntry) Commit(startTS, commitTS uint64) error {
 	return nil
 }
 
+// checkVersionCount checks whether adding a version to the entry exceeds
+// maxVersions, 0 means no limit.
+func (e *mvccEntry) checkVersionCount(maxVersions int) error {
+	if maxVersions <= 0 {
+		return nil
+	}
+	var versions int
+	for _, v := range e.values {
+		if v.valueType != typeRollback {
+			versions++
+		}
+	}
+	if versions >= maxVersions {
+		return &ErrTooManyVersions{Key: e.key.Raw(), Limit: maxVersions}
+	}
+	return nil
+}
+
+// rollbackStatus tells what mvccEntry.rollback found and did.
+type rollbackStatus int
+
+const (
+	// rollbackLock means the txn's lock is removed and a rollback record is
+	// written.
+	rollbackLock rollbackStatus = iota
+	// rollbackNotPrewritten means the txn is not found, a rollback record is
+	// written to prevent it from being prewritten or committed later.
+	rollbackNotPrewritten
+	// rollbackAlreadyRolledBack means the txn is already rolled back.
+	rollbackAlreadyRolledBack
+	// rollbackAlreadyCommitted means the txn is already committed and can't be
+	// rolled back.
+	rollbackAlreadyCommitted
+)
+
+func (r rollbackStatus) String() string {
+	switch r {
+	case rollbackLock:
+		return "rollback lock"
+	case rollbackNotPrewritten:
+		return "not prewritten"
+	case rollbackAlreadyRolledBack:
+		return "already rolled back"
+	case rollbackAlreadyCommitted:
+		return "already committed"
+	}
+	return "unknown"
+}
+
 func (e *mvccEntry) Rollback(startTS uint64) error {
+	_, err := e.rollback(startTS)
+	return err
+}
+
+func (e *mvccEntry) rollback(startTS uint64) (rollbackStatus, error) {
 	// If current transaction's lock exist.
 	if e.lock != nil && e.lock.startTS == startTS {
 		e.lock = nil
@@ -174,7 +394,7 @@ func (e *mvccEntry) Rollback(startTS uint64) error {
 			startTS:   startTS,
 			commitTS:  startTS,
 		})
-		return nil
+		return rollbackLock, nil
 	}
 
 	// If current transaction's lock not exist.
@@ -182,10 +402,10 @@ func (e *mvccEntry) Rollback(startTS uint64) error {
 	if c := e.getTxnCommitInfo(startTS); c != nil {
 		// If current transaction is already committed.
 		if c.valueType != typeRollback {
-			return ErrAlreadyCommitted(c.commitTS)
+			return rollbackAlreadyCommitted, ErrAlreadyCommitted(c.commitTS)
 		}
 		// If current transaction is already rollback.
-		return nil
+		return rollbackAlreadyRolledBack, nil
 	}
 	// If current transaction is not prewritted before.
 	e.addValue(mvccValue{
@@ -193,7 +413,44 @@ func (e *mvccEntry) Rollback(startTS uint64) error {
 		startTS:   startTS,
 		commitTS:  startTS,
 	})
-	return nil
+	return rollbackNotPrewritten, nil
+}
+
+// CheckTxnStatus checks the status of the transaction whose primary key is
+// this entry. See MvccStore.CheckTxnStatus.
+func (e *mvccEntry) CheckTxnStatus(lockTS, callerStartTS, currentTS uint64) (uint64, uint64, int, error) {
+	if e.lock != nil && e.lock.startTS == lockTS {
+		if e.lock.isExpired(currentTS) {
+			if err := e.Rollback(lockTS); err != nil {
+				return 0, 0, TxnActionNone, errors.Trace(err)
+			}
+			return 0, 0, TxnActionTTLExpireRollback, nil
+		}
+		action := TxnActionNone
+		// Push the lock's minCommitTS so that the caller can read without
+		// waiting for the lock. Only locks with a minCommitTS can be pushed,
+		// and a caller without a startTS pushes nothing.
+		hasMinCommitTS := e.lock.useAsyncCommit || e.lock.minCommitTS > 0
+		if hasMinCommitTS && callerStartTS > 0 && callerStartTS >= e.lock.minCommitTS {
+			e.lock.minCommitTS = callerStartTS + 1
+			action = TxnActionMinCommitTSPushed
+		}
+		return e.lock.remainingTTL(currentTS), 0, action, nil
+	}
+
+	if c := e.getTxnCommitInfo(lockTS); c != nil {
+		if c.valueType != typeRollback {
+			return 0, c.commitTS, TxnActionNone, nil
+		}
+		return 0, 0, TxnActionNone, nil
+	}
+
+	// The lock does not exist and the transaction is not committed, write a
+	// rollback record to prevent it from being committed later.
+	if err := e.Rollback(lockTS); err != nil {
+		return 0, 0, TxnActionNone, errors.Trace(err)
+	}
+	return 0, 0, TxnActionLockNotExistRollback, nil
 }
 
 func (e *mvccEntry) addValue(v mvccValue) {
@@ -206,6 +463,29 @@ func (e *mvccEntry) addValue(v mvccValue) {
 	}
 }
 
+// gc removes the versions which are not visible to any reader at or after
+// safePoint, and returns the removed versions.
+func (e *mvccEntry) gc(safePoint uint64) []mvccValue {
+	i := sort.Search(len(e.values), func(i int) bool { return e.values[i].commitTS <= safePoint })
+	values := append([]mvccValue(nil), e.values[:i]...)
+	var removed []mvccValue
+	latest := true
+	for _, v := range e.values[i:] {
+		if latest && v.valueType != typeRollback {
+			latest = false
+			if v.valueType == typePut {
+				values = append(values, v)
+				continue
+			}
+		}
+		removed = append(removed, v)
+	}
+	if len(removed) > 0 {
+		e.values = values
+	}
+	return removed
+}
+
 func (e *mvccEntry) containsStartTS(startTS uint64) bool {
 	if e.lock != nil && e.lock.startTS == startTS {
 		return true
@@ -221,6 +501,19 @@ func (e *mvccEntry) containsStartTS(startTS uint64) bool {
 	return false
 }
 
+// approximateSize returns the bytes taken by all versions and the lock of the
+// entry, counting the key once for each of them.
+func (e *mvccEntry) approximateSize() uint64 {
+	var size int
+	for _, v := range e.values {
+		size += len(e.key) + len(v.value)
+	}
+	if e.lock != nil {
+		size += len(e.key) + len(e.lock.primary) + len(e.lock.value)
+	}
+	return uint64(size)
+}
+
 func (e *mvccEntry) dumpMvccInfo() *kvrpcpb.MvccInfo {
 	info := &kvrpcpb.MvccInfo{}
 	if e.lock != nil {
@@ -290,6 +583,11 @@ type MVCCStore interface {
 	DeleteRange(startKey, endKey []byte) error
 	MvccGetByStartTS(startKey, endKey []byte, starTS uint64) (*kvrpcpb.MvccInfo, []byte)
 	MvccGetByKey(key []byte) *kvrpcpb.MvccInfo
+	CheckTxnStatus(primaryKey []byte, lockTS, callerStartTS, currentTS uint64) (ttl, commitTS uint64, action int, err error)
+	TxnHeartBeat(primaryKey []byte, startTS, advisedTTL uint64) (uint64, error)
+	BatchGetAndLock(keys [][]byte, primary []byte, startTS, forUpdateTS, ttl uint64) ([]Pair, []error)
+	PessimisticLock(mutations []*kvrpcpb.Mutation, primary []byte, startTS, forUpdateTS uint64, ttl uint64) []error
+	PessimisticRollback(keys [][]byte, startTS, forUpdateTS uint64) error
 }
 
 // RawKV is a key-value storage. MVCCStore can be implemented upon it with timestamp encoded into key.
@@ -305,6 +603,40 @@ type MvccStore struct {
 	sync.RWMutex
 	tree  *llrb.LLRB
 	rawkv *llrb.LLRB
+	// lockSeq is the sequence stamped onto the last lock acquired by Prewrite
+	// when enableLockSeq is set.
+	enableLockSeq bool
+	lockSeq       uint64
+	// oracle allocates timestamps for tests, see SetOracle.
+	oracle oracle.Oracle
+	// maxVersionsPerKey and maxValueSize limit the number of versions of a
+	// key and the size of a value, 0 means no limit.
+	maxVersionsPerKey int
+	maxValueSize      int
+	// strictPrimaryCheck makes Prewrite check that the primary key is one of
+	// the mutations.
+	strictPrimaryCheck bool
+	// maxScanLimit caps the number of Pairs returned by Scan, 0 means no cap.
+	maxScanLimit int
+	// gcSafePoint is the GC safe point set by SetGCSafePoint. Transactions
+	// starting before it fail to prewrite.
+	gcSafePoint uint64
+	// commitObserver is called for each put or delete being committed, see
+	// SetCommitObserver.
+	commitObserver func(key []byte, value []byte, commitTS uint64, opType mvccValueType)
+	// failpoints are the functions injected by SetFailpoint, keyed by op.
+	failpoints map[string]func() error
+	// gcDeletionLimit is the max number of versions recorded in gcDeletions,
+	// see SetGCDeletionLimit.
+	gcDeletionLimit int
+	gcDeletions     []DeletedVersion
+}
+
+// DeletedVersion is a version removed by GCRange.
+type DeletedVersion struct {
+	Key      []byte
+	StartTS  uint64
+	CommitTS uint64
 }
 
 // NewMvccStore creates a MvccStore.
@@ -315,14 +647,213 @@ func NewMvccStore() *MvccStore {
 	}
 }
 
+// SetMaxVersionsPerKey sets the max number of committed versions of a key.
+// Commit, BulkLoad and Import fail with ErrTooManyVersions instead of adding
+// more versions to a key, until the old versions are removed by GC. 0 removes
+// the limit.
+func (s *MvccStore) SetMaxVersionsPerKey(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.maxVersionsPerKey = n
+}
+
+// SetMaxValueSize sets the max size of a value, Prewrite fails with
+// ErrValueTooLarge for larger values. 0 removes the limit.
+func (s *MvccStore) SetMaxValueSize(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.maxValueSize = n
+}
+
+// checkValueSize checks the value of a mutation against the max value size.
+func (s *MvccStore) checkValueSize(m *kvrpcpb.Mutation) error {
+	if s.maxValueSize > 0 && len(m.Value) > s.maxValueSize {
+		return &ErrValueTooLarge{Key: m.Key, Size: len(m.Value), Limit: s.maxValueSize}
+	}
+	return nil
+}
+
+// SetStrictPrimaryCheck sets whether Prewrite checks that the primary key is one
+// of the mutations. It should only be enabled by tests which prewrite all keys
+// of a txn in one request, since the client prewrites secondary keys in
+// batches without the primary key.
+func (s *MvccStore) SetStrictPrimaryCheck(strict bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.strictPrimaryCheck = strict
+}
+
+// SetFailpoint injects fn into op, which is one of "get", "prewrite",
+// "commit", "rollback" and "cleanup". fn is called each time op is executed,
+// and if it returns an error, op returns the error without doing anything. A
+// nil fn clears the failpoint. fn is called with the store locked, so it must
+// not access the store.
+func (s *MvccStore) SetFailpoint(op string, fn func() error) {
+	s.Lock()
+	defer s.Unlock()
+	if fn == nil {
+		delete(s.failpoints, op)
+		return
+	}
+	if s.failpoints == nil {
+		s.failpoints = make(map[string]func() error)
+	}
+	s.failpoints[op] = fn
+}
+
+// evalFailpoint returns the error of the failpoint injected into op, the
+// caller must hold the lock of the store.
+func (s *MvccStore) evalFailpoint(op string) error {
+	if fn, ok := s.failpoints[op]; ok {
+		return fn()
+	}
+	return nil
+}
+
+// checkPrimary checks the primary key of a prewrite request, so that no lock
+// is written with a primary key pointing nowhere.
+func (s *MvccStore) checkPrimary(mutations []*kvrpcpb.Mutation, primary []byte) error {
+	if len(primary) == 0 {
+		return ErrAbort("empty primary key")
+	}
+	if !s.strictPrimaryCheck {
+		return nil
+	}
+	for _, m := range mutations {
+		if bytes.Equal(m.Key, primary) {
+			return nil
+		}
+	}
+	return ErrAbort(fmt.Sprintf("primary key %q is not in mutations", primary))
+}
+
+// SetMaxScanLimit sets the max number of Pairs returned by Scan. If a Scan
+// asks for more and more Pairs are available, the result is truncated and ends
+// with a Pair whose Err is ErrScanLimitExceeded. 0 removes the cap.
+func (s *MvccStore) SetMaxScanLimit(limit int) {
+	s.Lock()
+	defer s.Unlock()
+	s.maxScanLimit = limit
+}
+
+// SetGCSafePoint sets the GC safe point of the store. The versions older than
+// it may have been removed by GC, so conflicts can't be detected reliably for
+// transactions starting before it, and their prewrites are rejected.
+func (s *MvccStore) SetGCSafePoint(ts uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.gcSafePoint = ts
+}
+
+// SetGCDeletionLimit makes GCRange record at most limit versions it removes,
+// which can be retrieved by LastGCDeletions. 0 stops recording.
+func (s *MvccStore) SetGCDeletionLimit(limit int) {
+	s.Lock()
+	defer s.Unlock()
+	s.gcDeletionLimit = limit
+	s.gcDeletions = nil
+}
+
+// LastGCDeletions returns the versions removed by the last GCRange, in the
+// order they are removed, up to the limit set by SetGCDeletionLimit.
+func (s *MvccStore) LastGCDeletions() []DeletedVersion {
+	s.RLock()
+	defer s.RUnlock()
+	return append([]DeletedVersion(nil), s.gcDeletions...)
+}
+
+// SetCommitObserver sets a function to be called for each put or delete
+// committed by Commit, ResolveLock, BatchResolveLock, ApplyEvents and the other
+// commit paths, after the entries are written. Keys of Op_Lock mutations are not reported. The observer is called
+// with the store locked, so it must not call back into the store. nil removes
+// the observer.
+func (s *MvccStore) SetCommitObserver(fn func(key []byte, value []byte, commitTS uint64, opType mvccValueType)) {
+	s.Lock()
+	defer s.Unlock()
+	s.commitObserver = fn
+}
+
+// isCommitObserved checks whether committing startTS on the entry writes a
+// value that should be reported to the commit observer.
+func (s *MvccStore) isCommitObserved(e *mvccEntry, startTS uint64) bool {
+	return s.commitObserver != nil && e.lock != nil && e.lock.startTS == startTS && e.lock.op != kvrpcpb.Op_Lock
+}
+
+// committedValue is a value written by a commit, kept to be reported to the
+// commit observer after the entries are written.
+type committedValue struct {
+	key MvccKey
+	*mvccValue
+}
+
+// notifyCommitted reports the committed values to the commit observer.
+func (s *MvccStore) notifyCommitted(values []committedValue) {
+	for _, v := range values {
+		s.commitObserver(v.key.Raw(), v.value, v.commitTS, v.valueType)
+	}
+}
+
+// SetOracle sets the oracle used by GetTimestamp.
+func (s *MvccStore) SetOracle(o oracle.Oracle) {
+	s.Lock()
+	defer s.Unlock()
+	s.oracle = o
+}
+
+// GetTimestamp allocates a timestamp from the oracle set by SetOracle.
+func (s *MvccStore) GetTimestamp() (uint64, error) {
+	s.RLock()
+	o := s.oracle
+	s.RUnlock()
+	if o == nil {
+		return 0, errors.New("oracle is not set")
+	}
+	ts, err := o.GetTimestamp(goctx.Background())
+	return ts, errors.Trace(err)
+}
+
+// EnableLockSeq makes Prewrite stamp each new lock with a monotonically
+// increasing sequence number, which can be read by GetLock. It is used by tests
+// to check the order in which locks are acquired.
+func (s *MvccStore) EnableLockSeq(enable bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.enableLockSeq = enable
+}
+
 // Get reads a key by ts.
 func (s *MvccStore) Get(key []byte, startTS uint64, isoLevel kvrpcpb.IsolationLevel) ([]byte, error) {
+	start := time.Now()
+	defer func() { mvccCmdHistogram.WithLabelValues("get").Observe(time.Since(start).Seconds()) }()
 	s.RLock()
 	defer s.RUnlock()
 
+	if err := s.evalFailpoint("get"); err != nil {
+		return nil, err
+	}
 	return s.get(NewMvccKey(key), startTS, isoLevel)
 }
 
+// GetWithVersion is like Get, but also returns the commitTS of the version
+// read. The commitTS is 0 if the key is not found.
+func (s *MvccStore) GetWithVersion(key []byte, startTS uint64, isoLevel kvrpcpb.IsolationLevel) ([]byte, uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if err := s.evalFailpoint("get"); err != nil {
+		return nil, 0, err
+	}
+	entry := s.tree.Get(newEntry(NewMvccKey(key)))
+	if entry == nil {
+		return nil, 0, nil
+	}
+	v, err := entry.(*mvccEntry).getVersion(startTS, isoLevel)
+	if v == nil || v.valueType == typeDelete || err != nil {
+		return nil, 0, err
+	}
+	return v.value, v.commitTS, nil
+}
+
 func (s *MvccStore) get(key MvccKey, startTS uint64, isoLevel kvrpcpb.IsolationLevel) ([]byte, error) {
 	entry := s.tree.Get(newEntry(key))
 	if entry == nil {
@@ -331,6 +862,115 @@ func (s *MvccStore) get(key MvccKey, startTS uint64, isoLevel kvrpcpb.IsolationL
 	return entry.(*mvccEntry).Get(startTS, isoLevel)
 }
 
+// GetWithLockInfo reads a key by startTS under SI. If a lock blocks the read,
+// it returns the lock's info instead of an error, so the caller can check the
+// status of the lock's txn.
+func (s *MvccStore) GetWithLockInfo(key []byte, startTS uint64) ([]byte, *kvrpcpb.LockInfo, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	val, err := s.get(NewMvccKey(key), startTS, kvrpcpb.IsolationLevel_SI)
+	if locked, ok := err.(*ErrLocked); ok {
+		return nil, &kvrpcpb.LockInfo{
+			Key:         locked.Key.Raw(),
+			PrimaryLock: locked.Primary,
+			LockVersion: locked.StartTS,
+			LockTtl:     locked.TTL,
+		}, nil
+	}
+	return val, nil, errors.Trace(err)
+}
+
+// GetBoundedStaleness reads the newest committed version of key whose commitTS
+// is in [minTS, maxTS], ignoring locks. It returns the value and the version's
+// commitTS, the value is nil if the version is a delete. If no version is in
+// the range, both results are zero.
+func (s *MvccStore) GetBoundedStaleness(key []byte, minTS, maxTS uint64) ([]byte, uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	item := s.tree.Get(newEntry(NewMvccKey(key)))
+	if item == nil {
+		return nil, 0, nil
+	}
+	v := item.(*mvccEntry).getBoundedStaleness(minTS, maxTS)
+	if v == nil {
+		return nil, 0, nil
+	}
+	return v.value, v.commitTS, nil
+}
+
+// GetLockValue returns the value buffered in the lock of key if the lock
+// belongs to the transaction with startTS. The bool result reports whether
+// such a lock exists.
+func (s *MvccStore) GetLockValue(key []byte, startTS uint64) ([]byte, bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	item := s.tree.Get(newEntry(NewMvccKey(key)))
+	if item == nil {
+		return nil, false, nil
+	}
+	lock := item.(*mvccEntry).lock
+	if lock == nil || lock.startTS != startTS {
+		return nil, false, nil
+	}
+	return lock.value, true, nil
+}
+
+// GetLock returns the lock on key and its acquisition sequence, see
+// EnableLockSeq. It returns nil if the key is not locked.
+func (s *MvccStore) GetLock(key []byte) (*kvrpcpb.LockInfo, uint64) {
+	s.RLock()
+	defer s.RUnlock()
+
+	item := s.tree.Get(newEntry(NewMvccKey(key)))
+	if item == nil {
+		return nil, 0
+	}
+	lock := item.(*mvccEntry).lock
+	if lock == nil {
+		return nil, 0
+	}
+	return &kvrpcpb.LockInfo{
+		Key:         key,
+		PrimaryLock: lock.primary,
+		LockVersion: lock.startTS,
+		LockTtl:     lock.ttl,
+	}, lock.seq
+}
+
+// HasLock returns whether key is locked and the startTS of the lock. The error
+// is always nil for the in-memory store.
+func (s *MvccStore) HasLock(key []byte) (bool, uint64, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	item := s.tree.Get(newEntry(NewMvccKey(key)))
+	if item == nil || item.(*mvccEntry).lock == nil {
+		return false, 0, nil
+	}
+	return true, item.(*mvccEntry).lock.startTS, nil
+}
+
+// ForceUnlock removes the lock on key no matter which transaction it belongs
+// to, and returns whether there was a lock. No rollback record is written and
+// the committed versions are kept. It's unsafe because the owner of the lock
+// may still commit it, so it's only for cleaning up dangling locks in tests.
+func (s *MvccStore) ForceUnlock(key []byte) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	entry := s.getOrNewEntry(NewMvccKey(key))
+	if entry.lock == nil {
+		return false, nil
+	}
+	log.Warnf("[mocktikv] force unlock key %q of txn %d", key, entry.lock.startTS)
+	entry.lock = nil
+	s.submit(entry)
+	return true, nil
+}
+
 // A Pair is a KV pair read from MvccStore or an error if any occurs.
 type Pair struct {
 	Key   []byte
@@ -338,26 +978,109 @@ type Pair struct {
 	Err   error
 }
 
-// BatchGet gets values with keys and ts.
+// BatchGet gets values with keys and ts. The pairs are in the order of ks,
+// keys which don't exist are skipped, and duplicated keys get one pair for each
+// occurrence. Use BatchGetSorted to get the pairs sorted by key.
 func (s *MvccStore) BatchGet(ks [][]byte, startTS uint64, isoLevel kvrpcpb.IsolationLevel) []Pair {
 	s.RLock()
 	defer s.RUnlock()
 
+	// Read the keys in order in one pass of the tree. Seek to the next key
+	// instead if too many entries in between are not requested.
+	keys := make([]MvccKey, len(ks))
+	idx := make([]int, len(ks))
+	for i, k := range ks {
+		keys[i] = NewMvccKey(k)
+		idx[i] = i
+	}
+	sort.Sort(&keysByOrder{keys: keys, idx: idx})
+
+	vals := make([][]byte, len(ks))
+	errs := make([]error, len(ks))
+	for i := 0; i < len(idx); {
+		reseek := false
+		skipped := 0
+		iterator := func(item llrb.Item) bool {
+			ent := item.(*mvccEntry)
+			for i < len(idx) && bytes.Compare(keys[idx[i]], ent.key) < 0 {
+				i++
+			}
+			if i == len(idx) {
+				return false
+			}
+			if !bytes.Equal(keys[idx[i]], ent.key) {
+				skipped++
+				reseek = skipped >= batchGetMaxSkip
+				return !reseek
+			}
+			skipped = 0
+			val, err := ent.Get(startTS, isoLevel)
+			for ; i < len(idx) && bytes.Equal(keys[idx[i]], ent.key); i++ {
+				vals[idx[i]], errs[idx[i]] = val, err
+			}
+			return i < len(idx)
+		}
+		s.tree.AscendGreaterOrEqual(newEntry(keys[idx[i]]), iterator)
+		if !reseek {
+			break
+		}
+	}
+
 	var pairs []Pair
-	for _, k := range ks {
-		val, err := s.get(NewMvccKey(k), startTS, isoLevel)
-		if val == nil && err == nil {
+	for i, k := range ks {
+		if vals[i] == nil && errs[i] == nil {
 			continue
 		}
 		pairs = append(pairs, Pair{
 			Key:   k,
-			Value: val,
-			Err:   err,
+			Value: vals[i],
+			Err:   errs[i],
 		})
 	}
 	return pairs
 }
 
+// BatchGetSorted is like BatchGet, but the pairs are sorted by key regardless of
+// the order of ks.
+func (s *MvccStore) BatchGetSorted(ks [][]byte, startTS uint64, isoLevel kvrpcpb.IsolationLevel) []Pair {
+	pairs := s.BatchGet(ks, startTS, isoLevel)
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].Key, pairs[j].Key) < 0
+	})
+	return pairs
+}
+
+// batchGetMaxSkip is the number of entries BatchGet walks through without
+// finding a requested key before it seeks to the next key.
+const batchGetMaxSkip = 16
+
+// keysByOrder sorts keys together with their original indexes.
+type keysByOrder struct {
+	keys []MvccKey
+	idx  []int
+}
+
+func (k *keysByOrder) Len() int {
+	return len(k.idx)
+}
+
+func (k *keysByOrder) Less(i, j int) bool {
+	return bytes.Compare(k.keys[k.idx[i]], k.keys[k.idx[j]]) < 0
+}
+
+func (k *keysByOrder) Swap(i, j int) {
+	k.idx[i], k.idx[j] = k.idx[j], k.idx[i]
+}
+
+// validateRange checks that startKey is not greater than endKey. An empty
+// endKey means the range is unbounded.
+func validateRange(startKey, endKey []byte) error {
+	if len(endKey) > 0 && bytes.Compare(startKey, endKey) > 0 {
+		return errors.Errorf("invalid range, startKey %q is greater than endKey %q", startKey, endKey)
+	}
+	return nil
+}
+
 func regionContains(startKey []byte, endKey []byte, key []byte) bool {
 	return bytes.Compare(startKey, key) <= 0 &&
 		(bytes.Compare(key, endKey) < 0 || len(endKey) == 0)
@@ -365,12 +1088,22 @@ func regionContains(startKey []byte, endKey []byte, key []byte) bool {
 
 // Scan reads up to a limited number of Pairs that greater than or equal to startKey and less than endKey.
 func (s *MvccStore) Scan(startKey, endKey []byte, limit int, startTS uint64, isoLevel kvrpcpb.IsolationLevel) []Pair {
+	start := time.Now()
+	defer func() { mvccCmdHistogram.WithLabelValues("scan").Observe(time.Since(start).Seconds()) }()
+	if err := validateRange(startKey, endKey); err != nil {
+		return []Pair{{Err: err}}
+	}
 	s.RLock()
 	defer s.RUnlock()
 
 	startKey = NewMvccKey(startKey)
 	endKey = NewMvccKey(endKey)
 
+	capped := s.maxScanLimit > 0 && limit > s.maxScanLimit
+	if capped {
+		// Read one more Pair to know whether the result is truncated.
+		limit = s.maxScanLimit + 1
+	}
 	var pairs []Pair
 	iterator := func(item llrb.Item) bool {
 		if len(pairs) >= limit {
@@ -391,12 +1124,196 @@ func (s *MvccStore) Scan(startKey, endKey []byte, limit int, startTS uint64, iso
 		return true
 	}
 	s.tree.AscendGreaterOrEqual(newEntry(startKey), iterator)
+	if capped && len(pairs) == limit {
+		pairs[len(pairs)-1] = Pair{Err: ErrScanLimitExceeded}
+	}
 	return pairs
 }
 
-// ReverseScan reads up to a limited number of Pairs that greater than or equal to startKey and less than endKey
-// in descending order.
+// ScanResumable is like Scan, but also returns the key to pass as startKey of
+// the next call to continue right after the returned Pairs. The next key is nil
+// if no key is left in the range. It's not affected by the max scan limit.
+func (s *MvccStore) ScanResumable(startKey, endKey []byte, limit int, startTS uint64, isoLevel kvrpcpb.IsolationLevel) ([]Pair, []byte) {
+	if err := validateRange(startKey, endKey); err != nil {
+		return []Pair{{Err: err}}, nil
+	}
+	s.RLock()
+	defer s.RUnlock()
+
+	startKey = NewMvccKey(startKey)
+	endKey = NewMvccKey(endKey)
+
+	var pairs []Pair
+	var nextKey []byte
+	iterator := func(item llrb.Item) bool {
+		k := item.(*mvccEntry).key
+		if !regionContains(startKey, endKey, k) {
+			return false
+		}
+		if len(pairs) >= limit {
+			nextKey = k.Raw()
+			return false
+		}
+		val, err := s.get(k, startTS, isoLevel)
+		if val != nil || err != nil {
+			pairs = append(pairs, Pair{
+				Key:   k.Raw(),
+				Value: val,
+				Err:   err,
+			})
+		}
+		return true
+	}
+	s.tree.AscendGreaterOrEqual(newEntry(startKey), iterator)
+	return pairs, nextKey
+}
+
+// ScanKeys returns up to limit keys in [startKey, endKey) which have a visible
+// value at startTS. It's like Scan without values, but returns the first lock
+// error met under SI instead of a Pair.
+func (s *MvccStore) ScanKeys(startKey, endKey []byte, limit int, startTS uint64, isoLevel kvrpcpb.IsolationLevel) ([][]byte, error) {
+	if err := validateRange(startKey, endKey); err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.RLock()
+	defer s.RUnlock()
+
+	startKey = NewMvccKey(startKey)
+	endKey = NewMvccKey(endKey)
+
+	var (
+		keys [][]byte
+		err  error
+	)
+	iterator := func(item llrb.Item) bool {
+		if len(keys) >= limit {
+			return false
+		}
+		ent := item.(*mvccEntry)
+		if !regionContains(startKey, endKey, ent.key) {
+			return false
+		}
+		var val []byte
+		val, err = ent.Get(startTS, isoLevel)
+		if err != nil {
+			return false
+		}
+		if val != nil {
+			keys = append(keys, ent.key.Raw())
+		}
+		return true
+	}
+	s.tree.AscendGreaterOrEqual(newEntry(startKey), iterator)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return keys, nil
+}
+
+// ScanCursor reads the Pairs in a range one at a time, so the memory it takes
+// doesn't grow with the number of Pairs read. It skips deleted keys and returns
+// a Pair with Err set for a locked key, the same as Scan.
+type ScanCursor struct {
+	store    *MvccStore
+	nextKey  MvccKey
+	endKey   MvccKey
+	startTS  uint64
+	isoLevel kvrpcpb.IsolationLevel
+	closed   bool
+}
+
+// ScanCursor creates a ScanCursor that reads the Pairs in [startKey, endKey) by
+// startTS.
+func (s *MvccStore) ScanCursor(startKey, endKey []byte, startTS uint64, isoLevel kvrpcpb.IsolationLevel) *ScanCursor {
+	return &ScanCursor{
+		store:    s,
+		nextKey:  NewMvccKey(startKey),
+		endKey:   NewMvccKey(endKey),
+		startTS:  startTS,
+		isoLevel: isoLevel,
+	}
+}
+
+// Next returns the next Pair. The bool result is false if there are no more
+// Pairs or the cursor is closed.
+func (c *ScanCursor) Next() (Pair, bool) {
+	if c.closed {
+		return Pair{}, false
+	}
+	c.store.RLock()
+	defer c.store.RUnlock()
+
+	var (
+		pair  Pair
+		found bool
+	)
+	iterator := func(item llrb.Item) bool {
+		ent := item.(*mvccEntry)
+		if !regionContains(c.nextKey, c.endKey, ent.key) {
+			return false
+		}
+		// The tree may change between calls, so remember where to seek next
+		// time instead of holding the position.
+		c.nextKey = NextKey(ent.key)
+		val, err := ent.Get(c.startTS, c.isoLevel)
+		if val != nil || err != nil {
+			pair = Pair{
+				Key:   ent.key.Raw(),
+				Value: val,
+				Err:   err,
+			}
+			found = true
+			return false
+		}
+		return true
+	}
+	c.store.tree.AscendGreaterOrEqual(newEntry(c.nextKey), iterator)
+	if !found {
+		c.closed = true
+	}
+	return pair, found
+}
+
+// Close closes the cursor. Next returns false after it's closed.
+func (c *ScanCursor) Close() {
+	c.closed = true
+}
+
+// ScanPrefix reads up to limit Pairs whose keys start with prefix, the same as
+// Scan.
+func (s *MvccStore) ScanPrefix(prefix []byte, limit int, startTS uint64, isoLevel kvrpcpb.IsolationLevel) []Pair {
+	return s.Scan(prefix, prefixEnd(prefix), limit, startTS, isoLevel)
+}
+
+// NextKey returns the smallest key greater than key, which is key followed by a
+// 0 byte. Unlike prefixEnd, it never skips keys with key as the prefix, so the
+// next key of "" is "\x00" and the next key of "a\xff" is "a\xff\x00".
+func NextKey(key []byte) []byte {
+	next := make([]byte, len(key)+1)
+	copy(next, key)
+	return next
+}
+
+// prefixEnd returns the smallest key greater than all keys with prefix, which
+// is the prefix with trailing 0xff bytes removed and the last byte increased.
+// It returns nil if prefix is empty or all 0xff, meaning no upper bound.
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := append([]byte(nil), prefix[:i+1]...)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+// ReverseScan reads up to a limited number of Pairs that greater than or equal to startKey and less than endKey
+// in descending order.
 func (s *MvccStore) ReverseScan(startKey, endKey []byte, limit int, startTS uint64, isoLevel kvrpcpb.IsolationLevel) []Pair {
+	if err := validateRange(startKey, endKey); err != nil {
+		return []Pair{{Err: err}}
+	}
 	s.RLock()
 	defer s.RUnlock()
 
@@ -425,148 +1342,1067 @@ func (s *MvccStore) ReverseScan(startKey, endKey []byte, limit int, startTS uint
 		}
 		return true
 	}
-	s.tree.DescendLessOrEqual(newEntry(endKey), iterator)
-	return pairs
-}
-
-func (s *MvccStore) getOrNewEntry(key []byte) *mvccEntry {
-	if item := s.tree.Get(newEntry(key)); item != nil {
-		return item.(*mvccEntry).Clone()
+	if len(endKey) == 0 {
+		// No upper bound, start from the largest key.
+		max := s.tree.Max()
+		if max == nil {
+			return nil
+		}
+		s.tree.DescendLessOrEqual(max, iterator)
+		return pairs
+	}
+	s.tree.DescendLessOrEqual(newEntry(endKey), iterator)
+	return pairs
+}
+
+func (s *MvccStore) getOrNewEntry(key []byte) *mvccEntry {
+	if item := s.tree.Get(newEntry(key)); item != nil {
+		return item.(*mvccEntry).Clone()
+	}
+	return newEntry(key)
+}
+
+// submit writes entries into the rbtree.
+func (s *MvccStore) submit(ents ...*mvccEntry) {
+	for _, ent := range ents {
+		s.tree.ReplaceOrInsert(ent)
+	}
+}
+
+// Prewrite acquires a lock on a key. (1st phase of 2PC).
+func (s *MvccStore) Prewrite(mutations []*kvrpcpb.Mutation, primary []byte, startTS uint64, ttl uint64) []error {
+	start := time.Now()
+	defer func() { mvccCmdHistogram.WithLabelValues("prewrite").Observe(time.Since(start).Seconds()) }()
+	return s.prewrite(mutations, primary, startTS, ttl, nil)
+}
+
+// PrewriteAsyncCommit is like Prewrite, but marks the locks as async commit
+// locks with minCommitTS. The primary lock records the secondary keys, so the
+// status of the txn can be decided by checking all its locks.
+func (s *MvccStore) PrewriteAsyncCommit(mutations []*kvrpcpb.Mutation, primary []byte, startTS, ttl, minCommitTS uint64, secondaries [][]byte) []error {
+	return s.prewrite(mutations, primary, startTS, ttl, func(key []byte, lock *mvccLock) {
+		lock.useAsyncCommit = true
+		lock.minCommitTS = minCommitTS
+		if bytes.Equal(key, primary) {
+			lock.secondaries = secondaries
+		}
+	})
+}
+
+// PrewriteReturnValues is like Prewrite, but also returns the latest committed
+// values of the keys before they are locked. The values are parallel to
+// mutations, and the value is nil if the key doesn't exist or fails to be
+// locked.
+func (s *MvccStore) PrewriteReturnValues(mutations []*kvrpcpb.Mutation, primary []byte, startTS uint64, ttl uint64) ([][]byte, []error) {
+	prevValues := make(map[string][]byte)
+	errs := s.prewrite(mutations, primary, startTS, ttl, func(key []byte, lock *mvccLock) {
+		if prev := s.latestValue(NewMvccKey(key)); prev != nil {
+			prevValues[string(key)] = prev
+		}
+	})
+	values := make([][]byte, len(mutations))
+	for i, m := range mutations {
+		if errs[i] == nil {
+			values[i] = prevValues[string(m.Key)]
+		}
+	}
+	return values, errs
+}
+
+// latestValue returns the value of the latest committed version of key, the
+// caller must hold the lock of the store.
+func (s *MvccStore) latestValue(key MvccKey) []byte {
+	entry := s.tree.Get(newEntry(key))
+	if entry == nil {
+		return nil
+	}
+	v, _ := entry.(*mvccEntry).getVersion(0, kvrpcpb.IsolationLevel_RC)
+	if v == nil || v.valueType == typeDelete {
+		return nil
+	}
+	return v.value
+}
+
+func (s *MvccStore) prewrite(mutations []*kvrpcpb.Mutation, primary []byte, startTS uint64, ttl uint64, setLock func(key []byte, lock *mvccLock)) []error {
+	s.Lock()
+	defer s.Unlock()
+
+	var errs []error
+	if err := s.evalFailpoint("prewrite"); err != nil {
+		for range mutations {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+	if startTS < s.gcSafePoint {
+		for range mutations {
+			errs = append(errs, ErrRetryable("startTS below GC safepoint"))
+		}
+		return errs
+	}
+	if err := s.checkPrimary(mutations, primary); err != nil {
+		for range mutations {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+	for _, m := range mutations {
+		if err := s.checkValueSize(m); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		entry := s.getOrNewEntry(NewMvccKey(m.Key))
+		err := entry.Prewrite(m, startTS, primary, ttl)
+		if err == nil && s.enableLockSeq && entry.lock.seq == 0 {
+			s.lockSeq++
+			entry.lock.seq = s.lockSeq
+		}
+		if err == nil && setLock != nil {
+			setLock(m.Key, entry.lock)
+		}
+		s.submit(entry)
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// PrewriteDryRun runs the checks of Prewrite on mutations and returns the same
+// errors, without writing any lock into the store.
+func (s *MvccStore) PrewriteDryRun(mutations []*kvrpcpb.Mutation, primary []byte, startTS uint64) []error {
+	s.RLock()
+	defer s.RUnlock()
+
+	var errs []error
+	if startTS < s.gcSafePoint {
+		for range mutations {
+			errs = append(errs, ErrRetryable("startTS below GC safepoint"))
+		}
+		return errs
+	}
+	if err := s.checkPrimary(mutations, primary); err != nil {
+		for range mutations {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+	// Later mutations on the same key see the locks of earlier ones, the same
+	// as Prewrite.
+	staged := make(map[string]*mvccEntry)
+	for _, m := range mutations {
+		if err := s.checkValueSize(m); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		key := NewMvccKey(m.Key)
+		entry, ok := staged[string(key)]
+		if !ok {
+			entry = s.getOrNewEntry(key)
+			staged[string(key)] = entry
+		}
+		errs = append(errs, entry.Prewrite(m, startTS, primary, 0))
+	}
+	return errs
+}
+
+// PessimisticLock acquires pessimistic locks on the keys of mutations. The locks
+// block other writers until they are turned into normal locks by Prewrite of
+// the same txn or removed by PessimisticRollback.
+func (s *MvccStore) PessimisticLock(mutations []*kvrpcpb.Mutation, primary []byte, startTS, forUpdateTS uint64, ttl uint64) []error {
+	s.Lock()
+	defer s.Unlock()
+
+	var errs []error
+	for _, m := range mutations {
+		entry := s.getOrNewEntry(NewMvccKey(m.Key))
+		err := entry.PessimisticLock(startTS, forUpdateTS, primary, ttl)
+		s.submit(entry)
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// PessimisticRollback removes the pessimistic locks of the txn on keys.
+func (s *MvccStore) PessimisticRollback(keys [][]byte, startTS, forUpdateTS uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var ents []*mvccEntry
+	for _, k := range keys {
+		entry := s.getOrNewEntry(NewMvccKey(k))
+		if entry.PessimisticRollback(startTS, forUpdateTS) {
+			ents = append(ents, entry)
+		}
+	}
+	s.submit(ents...)
+	return nil
+}
+
+// BatchGetAndLock acquires pessimistic locks on keys and reads their latest
+// values committed before forUpdateTS, like `SELECT ... FOR UPDATE`. The keys
+// are locked atomically: if any key fails to be locked, none of the locks is
+// written. The returned errors are parallel to keys, and the pairs skip the
+// keys which don't exist.
+func (s *MvccStore) BatchGetAndLock(keys [][]byte, primary []byte, startTS, forUpdateTS, ttl uint64) ([]Pair, []error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var (
+		ents   []*mvccEntry
+		pairs  []Pair
+		errs   = make([]error, len(keys))
+		failed bool
+	)
+	for i, k := range keys {
+		entry := s.getOrNewEntry(NewMvccKey(k))
+		val, err := entry.Get(forUpdateTS, kvrpcpb.IsolationLevel_RC)
+		if err == nil {
+			err = entry.PessimisticLock(startTS, forUpdateTS, primary, ttl)
+		}
+		if err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+		ents = append(ents, entry)
+		if val != nil {
+			pairs = append(pairs, Pair{
+				Key:   k,
+				Value: val,
+			})
+		}
+	}
+	if failed {
+		return nil, errs
+	}
+	s.submit(ents...)
+	return pairs, errs
+}
+
+// Commit commits the lock on a key. (2nd phase of 2PC).
+func (s *MvccStore) Commit(keys [][]byte, startTS, commitTS uint64) error {
+	start := time.Now()
+	defer func() { mvccCmdHistogram.WithLabelValues("commit").Observe(time.Since(start).Seconds()) }()
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.evalFailpoint("commit"); err != nil {
+		return err
+	}
+	return s.commitKeys(keys, startTS, commitTS)
+}
+
+// CommitWithPrimary commits the primary key before the other keys, which is
+// the commit point of the transaction. If committing the other keys fails, the
+// transaction is still committed and their locks can be resolved by checking
+// the primary key. primary in keys is ignored.
+func (s *MvccStore) CommitWithPrimary(primary []byte, keys [][]byte, startTS, commitTS uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.commitKeys([][]byte{primary}, startTS, commitTS); err != nil {
+		return err
+	}
+	var secondaries [][]byte
+	for _, k := range keys {
+		if !bytes.Equal(k, primary) {
+			secondaries = append(secondaries, k)
+		}
+	}
+	return s.commitKeys(secondaries, startTS, commitTS)
+}
+
+// commitKeys commits the locks on keys in one write, the caller must hold the
+// lock of the store.
+func (s *MvccStore) commitKeys(keys [][]byte, startTS, commitTS uint64) error {
+	var ents []*mvccEntry
+	var observed []committedValue
+	for _, k := range keys {
+		entry := s.getOrNewEntry(NewMvccKey(k))
+		observe := s.isCommitObserved(entry, startTS)
+		err := entry.Commit(startTS, commitTS, s.maxVersionsPerKey)
+		if err != nil {
+			return err
+		}
+		if observe {
+			observed = append(observed, committedValue{entry.key, entry.getTxnCommitInfo(startTS)})
+		}
+		ents = append(ents, entry)
+	}
+	s.submit(ents...)
+	s.notifyCommitted(observed)
+	return nil
+}
+
+// BulkLoad writes kvs as the versions committed at commitTS by a transaction
+// started at commitTS-1, without prewriting or locking them. It's only for
+// seeding a store with data in tests, nothing is written if any key is locked,
+// already has a version committed at commitTS, or appears more than once.
+func (s *MvccStore) BulkLoad(kvs []Pair, commitTS uint64) error {
+	if commitTS == 0 {
+		return &ErrInvalidCommitTS{CommitTS: commitTS}
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	ents := make([]*mvccEntry, 0, len(kvs))
+	loaded := make(map[string]struct{}, len(kvs))
+	for _, kv := range kvs {
+		if _, ok := loaded[string(kv.Key)]; ok {
+			return ErrAbort(fmt.Sprintf("duplicate key %q", kv.Key))
+		}
+		loaded[string(kv.Key)] = struct{}{}
+		entry := s.getOrNewEntry(NewMvccKey(kv.Key))
+		if entry.lock != nil {
+			return entry.lockErr()
+		}
+		if err := entry.checkVersionCount(s.maxVersionsPerKey); err != nil {
+			return err
+		}
+		for _, v := range entry.values {
+			if v.commitTS == commitTS {
+				return &ErrWriteConflict{
+					Key:             entry.key,
+					StartTS:         commitTS - 1,
+					ConflictStartTS: v.startTS,
+					ConflictTS:      v.commitTS,
+				}
+			}
+		}
+		entry.addValue(mvccValue{
+			valueType: typePut,
+			startTS:   commitTS - 1,
+			commitTS:  commitTS,
+			value:     kv.Value,
+		})
+		ents = append(ents, entry)
+	}
+	s.submit(ents...)
+	return nil
+}
+
+// CommitReq is a request of CommitBatch to commit the keys of a transaction.
+type CommitReq struct {
+	Keys     [][]byte
+	StartTS  uint64
+	CommitTS uint64
+}
+
+// CommitBatch commits the keys of many transactions in one write. Each request
+// is checked against the locks of its own transaction like Commit, and the
+// returned errors are parallel to reqs. A failed request writes nothing, and
+// the writes of all the other requests become visible at the same time.
+func (s *MvccStore) CommitBatch(reqs []CommitReq) []error {
+	s.Lock()
+	defer s.Unlock()
+
+	errs := make([]error, len(reqs))
+	pending := make(map[string]*mvccEntry)
+	var observed []committedValue
+	for i, req := range reqs {
+		staged := make(map[string]*mvccEntry)
+		var stagedObserved []committedValue
+		for _, k := range req.Keys {
+			key := NewMvccKey(k)
+			ent, ok := staged[string(key)]
+			if !ok {
+				if ent, ok = pending[string(key)]; ok {
+					ent = ent.Clone()
+				} else {
+					ent = s.getOrNewEntry(key)
+				}
+				staged[string(key)] = ent
+			}
+			observe := s.isCommitObserved(ent, req.StartTS)
+			if err := ent.Commit(req.StartTS, req.CommitTS, s.maxVersionsPerKey); err != nil {
+				errs[i] = err
+				break
+			}
+			if observe {
+				stagedObserved = append(stagedObserved, committedValue{ent.key, ent.getTxnCommitInfo(req.StartTS)})
+			}
+		}
+		if errs[i] != nil {
+			continue
+		}
+		for k, ent := range staged {
+			pending[k] = ent
+		}
+		observed = append(observed, stagedObserved...)
+	}
+	for _, ent := range pending {
+		s.submit(ent)
+	}
+	s.notifyCommitted(observed)
+	return errs
+}
+
+// Cleanup cleanups a lock, often used when resolving a expired lock.
+func (s *MvccStore) Cleanup(key []byte, startTS uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.evalFailpoint("cleanup"); err != nil {
+		return err
+	}
+	entry := s.getOrNewEntry(NewMvccKey(key))
+	status, err := entry.rollback(startTS)
+	log.Debugf("[mocktikv] cleanup key %q of txn %d: %v", key, startTS, status)
+	if err != nil {
+		return err
+	}
+	s.submit(entry)
+	return nil
+}
+
+// Rollback cleanups multiple locks, often used when rolling back a conflict txn.
+func (s *MvccStore) Rollback(keys [][]byte, startTS uint64) error {
+	start := time.Now()
+	defer func() { mvccCmdHistogram.WithLabelValues("rollback").Observe(time.Since(start).Seconds()) }()
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.evalFailpoint("rollback"); err != nil {
+		return err
+	}
+	var ents []*mvccEntry
+	for _, k := range keys {
+		entry := s.getOrNewEntry(NewMvccKey(k))
+		err := entry.Rollback(startTS)
+		if err != nil {
+			return err
+		}
+		ents = append(ents, entry)
+	}
+	s.submit(ents...)
+	return nil
+}
+
+// MvccEventType is the type of an MvccEvent.
+type MvccEventType int
+
+// Types of MvccEvent.
+const (
+	EventPrewrite MvccEventType = iota
+	EventCommit
+	EventRollback
+)
+
+// MvccEvent is a transaction operation applied by ApplyEvents. Mutations,
+// Primary and TTL are used by EventPrewrite, Keys are used by EventCommit and
+// EventRollback, CommitTS is used by EventCommit.
+type MvccEvent struct {
+	Type      MvccEventType
+	Mutations []*kvrpcpb.Mutation
+	Keys      [][]byte
+	Primary   []byte
+	StartTS   uint64
+	CommitTS  uint64
+	TTL       uint64
+}
+
+// ApplyEvents applies the events in order. It's used by tests to build data
+// with a declared timeline. It stops at the first error and returns it, in
+// which case none of the events is applied.
+func (s *MvccStore) ApplyEvents(events []MvccEvent) error {
+	s.Lock()
+	defer s.Unlock()
+
+	pending := make(map[string]*mvccEntry)
+	getEntry := func(key []byte) *mvccEntry {
+		k := NewMvccKey(key)
+		if ent, ok := pending[string(k)]; ok {
+			return ent
+		}
+		ent := s.getOrNewEntry(k)
+		pending[string(k)] = ent
+		return ent
+	}
+	var observed []committedValue
+	for i, ev := range events {
+		var err error
+		switch ev.Type {
+		case EventPrewrite:
+			for _, m := range ev.Mutations {
+				ent := getEntry(m.Key)
+				if err = ent.Prewrite(m, ev.StartTS, ev.Primary, ev.TTL); err != nil {
+					break
+				}
+				if s.enableLockSeq && ent.lock.seq == 0 {
+					s.lockSeq++
+					ent.lock.seq = s.lockSeq
+				}
+			}
+		case EventCommit:
+			for _, k := range ev.Keys {
+				ent := getEntry(k)
+				observe := s.isCommitObserved(ent, ev.StartTS)
+				if err = ent.Commit(ev.StartTS, ev.CommitTS, s.maxVersionsPerKey); err != nil {
+					break
+				}
+				if observe {
+					// Later events may move the versions of the entry.
+					v := *ent.getTxnCommitInfo(ev.StartTS)
+					observed = append(observed, committedValue{ent.key, &v})
+				}
+			}
+		case EventRollback:
+			for _, k := range ev.Keys {
+				if err = getEntry(k).Rollback(ev.StartTS); err != nil {
+					break
+				}
+			}
+		default:
+			err = errors.Errorf("unknown event type %v", ev.Type)
+		}
+		if err != nil {
+			return errors.Annotatef(err, "apply event %d", i)
+		}
+	}
+	for _, ent := range pending {
+		s.submit(ent)
+	}
+	s.notifyCommitted(observed)
+	return nil
+}
+
+// Actions taken by CheckTxnStatus.
+const (
+	// TxnActionNone means the transaction status is unchanged.
+	TxnActionNone = iota
+	// TxnActionTTLExpireRollback means the primary lock is expired and rolled back.
+	TxnActionTTLExpireRollback
+	// TxnActionLockNotExistRollback means the primary lock is missing and a
+	// rollback record is written.
+	TxnActionLockNotExistRollback
+	// TxnActionMinCommitTSPushed means the primary lock's minCommitTS is pushed
+	// forward past the caller's startTS.
+	TxnActionMinCommitTSPushed
+)
+
+// CheckTxnStatus checks the status of the transaction whose primary key is
+// primaryKey and startTS is lockTS. If the transaction is still locked, the
+// remaining TTL is returned; if it is committed, commitTS is returned; if both
+// are 0, the transaction is rolled back. currentTS decides whether the lock is
+// expired, and callerStartTS is used to push the minCommitTS of an async commit
+// lock unless it is 0.
+func (s *MvccStore) CheckTxnStatus(primaryKey []byte, lockTS, callerStartTS, currentTS uint64) (ttl, commitTS uint64, action int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	entry := s.getOrNewEntry(NewMvccKey(primaryKey))
+	ttl, commitTS, action, err = entry.CheckTxnStatus(lockTS, callerStartTS, currentTS)
+	if err != nil {
+		return 0, 0, TxnActionNone, errors.Trace(err)
+	}
+	s.submit(entry)
+	return ttl, commitTS, action, nil
+}
+
+// TxnHeartBeat extends the TTL of the transaction's lock on its primary key to
+// advisedTTL, so a long running transaction is not resolved as dead. The TTL is
+// never shortened. It returns the TTL of the lock after the update.
+func (s *MvccStore) TxnHeartBeat(primaryKey []byte, startTS, advisedTTL uint64) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	entry := s.getOrNewEntry(NewMvccKey(primaryKey))
+	if entry.lock == nil || entry.lock.startTS != startTS {
+		return 0, &ErrTxnNotFound{StartTS: startTS, PrimaryKey: primaryKey}
+	}
+	if entry.lock.ttl < advisedTTL {
+		entry.lock.ttl = advisedTTL
+		s.submit(entry)
+	}
+	return entry.lock.ttl, nil
+}
+
+// AsyncCommitInfo returns the async commit metadata of the txn's lock on its
+// primary key, which complements CheckTxnStatus for async commit txns. ok is
+// false if the primary key is not locked by an async commit lock of the txn.
+func (s *MvccStore) AsyncCommitInfo(primaryKey []byte, lockTS uint64) (minCommitTS uint64, secondaries [][]byte, ok bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	item := s.tree.Get(newEntry(NewMvccKey(primaryKey)))
+	if item == nil {
+		return 0, nil, false
+	}
+	lock := item.(*mvccEntry).lock
+	if lock == nil || lock.startTS != lockTS || !lock.useAsyncCommit {
+		return 0, nil, false
+	}
+	return lock.minCommitTS, lock.secondaries, true
+}
+
+// ScanLock scans all orphan locks in a Region.
+func (s *MvccStore) ScanLock(startKey, endKey []byte, maxTS uint64) ([]*kvrpcpb.LockInfo, error) {
+	locks, _, err := s.ScanLockLimit(startKey, endKey, maxTS, 0)
+	return locks, errors.Trace(err)
+}
+
+// ScanLockLimit scans at most limit locks with startTS <= maxTS in the range.
+// It returns the key of the next such lock to resume the scan from, or nil if
+// there are no more locks. A limit <= 0 means no limit.
+func (s *MvccStore) ScanLockLimit(startKey, endKey []byte, maxTS uint64, limit int) ([]*kvrpcpb.LockInfo, []byte, error) {
+	if err := validateRange(startKey, endKey); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	s.RLock()
+	defer s.RUnlock()
+
+	var (
+		locks   []*kvrpcpb.LockInfo
+		nextKey []byte
+	)
+	iterator := func(item llrb.Item) bool {
+		ent := item.(*mvccEntry)
+		if !regionContains(startKey, endKey, ent.key) {
+			return false
+		}
+		if ent.lock != nil && ent.lock.startTS <= maxTS {
+			if limit > 0 && len(locks) >= limit {
+				nextKey = ent.key
+				return false
+			}
+			locks = append(locks, &kvrpcpb.LockInfo{
+				PrimaryLock: ent.lock.primary,
+				LockVersion: ent.lock.startTS,
+				Key:         ent.key.Raw(),
+			})
+		}
+		return true
+	}
+	s.tree.AscendGreaterOrEqual(newEntry(startKey), iterator)
+	return locks, nextKey, nil
+}
+
+// ScanLockByPrimary is like ScanLock, but only returns the locks whose primary
+// key is primary, which are the locks of the transactions with the primary key.
+func (s *MvccStore) ScanLockByPrimary(startKey, endKey []byte, maxTS uint64, primary []byte) ([]*kvrpcpb.LockInfo, error) {
+	if err := validateRange(startKey, endKey); err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.RLock()
+	defer s.RUnlock()
+
+	var locks []*kvrpcpb.LockInfo
+	s.tree.AscendGreaterOrEqual(newEntry(startKey), func(item llrb.Item) bool {
+		ent := item.(*mvccEntry)
+		if !regionContains(startKey, endKey, ent.key) {
+			return false
+		}
+		if ent.lock != nil && ent.lock.startTS <= maxTS && bytes.Equal(ent.lock.primary, primary) {
+			locks = append(locks, &kvrpcpb.LockInfo{
+				PrimaryLock: ent.lock.primary,
+				LockVersion: ent.lock.startTS,
+				Key:         ent.key.Raw(),
+			})
+		}
+		return true
+	})
+	return locks, nil
+}
+
+// ReverseScanLock is like ScanLock, but returns the locks in descending order
+// of keys, from the one before endKey down to startKey.
+func (s *MvccStore) ReverseScanLock(startKey, endKey []byte, maxTS uint64) ([]*kvrpcpb.LockInfo, error) {
+	if err := validateRange(startKey, endKey); err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.RLock()
+	defer s.RUnlock()
+
+	var locks []*kvrpcpb.LockInfo
+	iterator := func(item llrb.Item) bool {
+		ent := item.(*mvccEntry)
+		if bytes.Equal(ent.key, endKey) {
+			return true
+		}
+		if bytes.Compare(ent.key, startKey) < 0 {
+			return false
+		}
+		if ent.lock != nil && ent.lock.startTS <= maxTS {
+			locks = append(locks, &kvrpcpb.LockInfo{
+				PrimaryLock: ent.lock.primary,
+				LockVersion: ent.lock.startTS,
+				Key:         ent.key.Raw(),
+			})
+		}
+		return true
+	}
+	if len(endKey) == 0 {
+		// No upper bound, start from the largest key.
+		max := s.tree.Max()
+		if max == nil {
+			return nil, nil
+		}
+		s.tree.DescendLessOrEqual(max, iterator)
+		return locks, nil
 	}
-	return newEntry(key)
+	s.tree.DescendLessOrEqual(newEntry(endKey), iterator)
+	return locks, nil
 }
 
-// submit writes entries into the rbtree.
-func (s *MvccStore) submit(ents ...*mvccEntry) {
-	for _, ent := range ents {
-		s.tree.ReplaceOrInsert(ent)
+// BatchResolveLock resolves the orphan locks of many transactions in one scan.
+// txnInfos maps the startTS of each transaction to its commitTS, a zero
+// commitTS means the transaction is rolled back. Locks of other transactions
+// are left untouched.
+func (s *MvccStore) BatchResolveLock(startKey, endKey []byte, txnInfos map[uint64]uint64) error {
+	if err := validateRange(startKey, endKey); err != nil {
+		return errors.Trace(err)
 	}
-}
-
-// Prewrite acquires a lock on a key. (1st phase of 2PC).
-func (s *MvccStore) Prewrite(mutations []*kvrpcpb.Mutation, primary []byte, startTS uint64, ttl uint64) []error {
 	s.Lock()
 	defer s.Unlock()
 
-	var errs []error
-	for _, m := range mutations {
-		entry := s.getOrNewEntry(NewMvccKey(m.Key))
-		err := entry.Prewrite(m, startTS, primary, ttl)
-		s.submit(entry)
-		errs = append(errs, err)
+	var ents []*mvccEntry
+	var observed []committedValue
+	var err error
+	iterator := func(item llrb.Item) bool {
+		ent := item.(*mvccEntry)
+		if !regionContains(startKey, endKey, ent.key) {
+			return false
+		}
+		if ent.lock == nil {
+			return true
+		}
+		commitTS, ok := txnInfos[ent.lock.startTS]
+		if !ok {
+			return true
+		}
+		ent = ent.Clone()
+		startTS := ent.lock.startTS
+		if commitTS > 0 {
+			observe := s.isCommitObserved(ent, startTS)
+			err = ent.Commit(startTS, commitTS, s.maxVersionsPerKey)
+			if err == nil && observe {
+				observed = append(observed, committedValue{ent.key, ent.getTxnCommitInfo(startTS)})
+			}
+		} else {
+			err = ent.Rollback(startTS)
+		}
+		if err != nil {
+			return false
+		}
+		ents = append(ents, ent)
+		return true
 	}
-	return errs
+	s.tree.AscendGreaterOrEqual(newEntry(startKey), iterator)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.submit(ents...)
+	s.notifyCommitted(observed)
+	return nil
 }
 
-// Commit commits the lock on a key. (2nd phase of 2PC).
-func (s *MvccStore) Commit(keys [][]byte, startTS, commitTS uint64) error {
+// ResolveLock resolves all orphan locks belong to a transaction.
+func (s *MvccStore) ResolveLock(startKey, endKey []byte, startTS, commitTS uint64) error {
+	start := time.Now()
+	defer func() { mvccCmdHistogram.WithLabelValues("resolve_lock").Observe(time.Since(start).Seconds()) }()
+	if err := validateRange(startKey, endKey); err != nil {
+		return errors.Trace(err)
+	}
 	s.Lock()
 	defer s.Unlock()
 
 	var ents []*mvccEntry
-	for _, k := range keys {
-		entry := s.getOrNewEntry(NewMvccKey(k))
-		err := entry.Commit(startTS, commitTS)
-		if err != nil {
-			return err
+	var observed []committedValue
+	var err error
+	iterator := func(item llrb.Item) bool {
+		ent := item.(*mvccEntry)
+		if !regionContains(startKey, endKey, ent.key) {
+			return false
 		}
-		ents = append(ents, entry)
+		if ent.lock != nil && ent.lock.startTS == startTS {
+			if commitTS > 0 {
+				observe := s.isCommitObserved(ent, startTS)
+				err = ent.Commit(startTS, commitTS, s.maxVersionsPerKey)
+				if err == nil && observe {
+					observed = append(observed, committedValue{ent.key, ent.getTxnCommitInfo(startTS)})
+				}
+			} else {
+				var status rollbackStatus
+				status, err = ent.rollback(startTS)
+				log.Debugf("[mocktikv] resolve lock on key %q of txn %d: %v", ent.key.Raw(), startTS, status)
+			}
+			if err != nil {
+				return false
+			}
+			ents = append(ents, ent)
+		}
+		return true
+	}
+	s.tree.AscendGreaterOrEqual(newEntry(startKey), iterator)
+	if err != nil {
+		return errors.Trace(err)
 	}
 	s.submit(ents...)
+	s.notifyCommitted(observed)
 	return nil
 }
 
-// Cleanup cleanups a lock, often used when resolving a expired lock.
-func (s *MvccStore) Cleanup(key []byte, startTS uint64) error {
+// RollbackRange rolls back all locks of the transaction with startTS in
+// [startKey, endKey) in one write, leaving a rollback record on each key. Locks
+// of other transactions are left untouched.
+func (s *MvccStore) RollbackRange(startKey, endKey []byte, startTS uint64) error {
+	if err := validateRange(startKey, endKey); err != nil {
+		return errors.Trace(err)
+	}
 	s.Lock()
 	defer s.Unlock()
 
-	entry := s.getOrNewEntry(NewMvccKey(key))
-	err := entry.Rollback(startTS)
+	var ents []*mvccEntry
+	var err error
+	iterator := func(item llrb.Item) bool {
+		ent := item.(*mvccEntry)
+		if !regionContains(startKey, endKey, ent.key) {
+			return false
+		}
+		if ent.lock == nil || ent.lock.startTS != startTS {
+			return true
+		}
+		ent = ent.Clone()
+		if err = ent.Rollback(startTS); err != nil {
+			return false
+		}
+		ents = append(ents, ent)
+		return true
+	}
+	s.tree.AscendGreaterOrEqual(newEntry(startKey), iterator)
 	if err != nil {
-		return err
+		return errors.Trace(err)
 	}
-	s.submit(entry)
+	s.submit(ents...)
 	return nil
 }
 
-// Rollback cleanups multiple locks, often used when rolling back a conflict txn.
-func (s *MvccStore) Rollback(keys [][]byte, startTS uint64) error {
+// ResolveLockLite is like ResolveLock, but only resolves the locks on keys
+// instead of scanning a range. Keys not locked by the transaction are skipped.
+func (s *MvccStore) ResolveLockLite(keys [][]byte, startTS, commitTS uint64) error {
 	s.Lock()
 	defer s.Unlock()
 
 	var ents []*mvccEntry
+	var observed []committedValue
 	for _, k := range keys {
-		entry := s.getOrNewEntry(NewMvccKey(k))
-		err := entry.Rollback(startTS)
+		ent := s.getOrNewEntry(NewMvccKey(k))
+		if ent.lock == nil || ent.lock.startTS != startTS {
+			continue
+		}
+		var err error
+		if commitTS > 0 {
+			observe := s.isCommitObserved(ent, startTS)
+			err = ent.Commit(startTS, commitTS, s.maxVersionsPerKey)
+			if err == nil && observe {
+				observed = append(observed, committedValue{ent.key, ent.getTxnCommitInfo(startTS)})
+			}
+		} else {
+			err = ent.Rollback(startTS)
+		}
 		if err != nil {
-			return err
+			return errors.Trace(err)
 		}
-		ents = append(ents, entry)
+		ents = append(ents, ent)
 	}
 	s.submit(ents...)
+	s.notifyCommitted(observed)
 	return nil
 }
 
-// ScanLock scans all orphan locks in a Region.
-func (s *MvccStore) ScanLock(startKey, endKey []byte, maxTS uint64) ([]*kvrpcpb.LockInfo, error) {
+// ApproximateSize returns the approximate bytes taken by the keys in
+// [startKey, endKey), including all versions and locks.
+func (s *MvccStore) ApproximateSize(startKey, endKey []byte) (uint64, error) {
+	if err := validateRange(startKey, endKey); err != nil {
+		return 0, errors.Trace(err)
+	}
 	s.RLock()
 	defer s.RUnlock()
 
-	var locks []*kvrpcpb.LockInfo
+	startKey = NewMvccKey(startKey)
+	endKey = NewMvccKey(endKey)
+
+	var size uint64
 	iterator := func(item llrb.Item) bool {
 		ent := item.(*mvccEntry)
 		if !regionContains(startKey, endKey, ent.key) {
 			return false
 		}
-		if ent.lock != nil && ent.lock.startTS <= maxTS {
-			locks = append(locks, &kvrpcpb.LockInfo{
-				PrimaryLock: ent.lock.primary,
-				LockVersion: ent.lock.startTS,
-				Key:         ent.key.Raw(),
-			})
-		}
+		size += ent.approximateSize()
 		return true
 	}
 	s.tree.AscendGreaterOrEqual(newEntry(startKey), iterator)
-	return locks, nil
+	return size, nil
 }
 
-// ResolveLock resolves all orphan locks belong to a transaction.
-func (s *MvccStore) ResolveLock(startKey, endKey []byte, startTS, commitTS uint64) error {
-	s.Lock()
-	defer s.Unlock()
+// MvccStats is the statistics of the data in MvccStore.
+type MvccStats struct {
+	// Keys is the number of keys which have any version or lock.
+	Keys int
+	// Locks is the number of outstanding locks.
+	Locks int
+	// Versions is the number of committed versions, including deletions.
+	Versions int
+	// Rollbacks is the number of rollback records.
+	Rollbacks int
+	// Size is the approximate size in bytes of all the data.
+	Size uint64
+}
 
-	var ents []*mvccEntry
-	var err error
-	iterator := func(item llrb.Item) bool {
+// Stats scans the whole store and returns its statistics.
+func (s *MvccStore) Stats() MvccStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	var stats MvccStats
+	s.tree.AscendGreaterOrEqual(newEntry(nil), func(item llrb.Item) bool {
 		ent := item.(*mvccEntry)
-		if !regionContains(startKey, endKey, ent.key) {
-			return false
+		if ent.lock == nil && len(ent.values) == 0 {
+			return true
 		}
-		if ent.lock != nil && ent.lock.startTS == startTS {
-			if commitTS > 0 {
-				err = ent.Commit(startTS, commitTS)
+		stats.Keys++
+		if ent.lock != nil {
+			stats.Locks++
+		}
+		for _, v := range ent.values {
+			if v.valueType == typeRollback {
+				stats.Rollbacks++
 			} else {
-				err = ent.Rollback(startTS)
-			}
-			if err != nil {
-				return false
+				stats.Versions++
 			}
-			ents = append(ents, ent)
 		}
+		stats.Size += ent.approximateSize()
 		return true
+	})
+	return stats
+}
+
+// CheckConsistency scans the whole store and checks the invariants of every
+// key: no version is committed after the lock's startTS (or forUpdateTS for a
+// pessimistic lock), versions are in strictly descending order of commitTS,
+// and a txn doesn't have both a rollback record and a committed version. It
+// returns an error naming the first key which breaks any of them.
+func (s *MvccStore) CheckConsistency() error {
+	s.RLock()
+	defer s.RUnlock()
+
+	var err error
+	s.tree.AscendGreaterOrEqual(newEntry(nil), func(item llrb.Item) bool {
+		err = item.(*mvccEntry).checkConsistency()
+		return err == nil
+	})
+	return errors.Trace(err)
+}
+
+func (e *mvccEntry) checkConsistency() error {
+	if e.lock != nil {
+		lockTS := e.lock.startTS
+		if e.lock.forUpdateTS > lockTS {
+			lockTS = e.lock.forUpdateTS
+		}
+		for _, v := range e.values {
+			if v.valueType != typeRollback && v.commitTS > lockTS {
+				return errors.Errorf("key %q is locked at %v but committed at %v", e.key.Raw(), lockTS, v.commitTS)
+			}
+		}
 	}
-	s.tree.AscendGreaterOrEqual(newEntry(startKey), iterator)
+	rollbacks := make(map[uint64]bool)
+	commits := make(map[uint64]bool)
+	for i, v := range e.values {
+		if i > 0 && v.commitTS >= e.values[i-1].commitTS {
+			return errors.Errorf("versions of key %q are out of order, commitTS %v is after %v", e.key.Raw(), v.commitTS, e.values[i-1].commitTS)
+		}
+		if v.valueType == typeRollback {
+			rollbacks[v.startTS] = true
+		} else {
+			commits[v.startTS] = true
+		}
+		if rollbacks[v.startTS] && commits[v.startTS] {
+			return errors.Errorf("txn %v of key %q is both committed and rolled back", v.startTS, e.key.Raw())
+		}
+	}
+	return nil
+}
+
+// Export returns the value of every key visible at ts, which is a logical
+// snapshot of the store. Deleted keys are skipped. It fails if any key is
+// locked at ts.
+func (s *MvccStore) Export(ts uint64) ([]Pair, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var (
+		pairs []Pair
+		err   error
+	)
+	s.tree.AscendGreaterOrEqual(newEntry(nil), func(item llrb.Item) bool {
+		ent := item.(*mvccEntry)
+		var v *mvccValue
+		v, err = ent.getVersion(ts, kvrpcpb.IsolationLevel_SI)
+		if err != nil {
+			return false
+		}
+		// A key put with an empty value is exported too.
+		if v != nil && v.valueType == typePut {
+			pairs = append(pairs, Pair{
+				Key:   ent.key.Raw(),
+				Value: v.value,
+			})
+		}
+		return true
+	})
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
+	}
+	return pairs, nil
+}
+
+// Import writes the pairs exported by Export. They are committed by one
+// synthetic transaction which is newer than all data in the store, and its
+// commitTS is returned. It fails without writing anything if any key is
+// locked.
+func (s *MvccStore) Import(pairs []Pair) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var maxTS uint64
+	s.tree.AscendGreaterOrEqual(newEntry(nil), func(item llrb.Item) bool {
+		ent := item.(*mvccEntry)
+		if len(ent.values) > 0 && ent.values[0].commitTS > maxTS {
+			maxTS = ent.values[0].commitTS
+		}
+		if ent.lock != nil && ent.lock.startTS > maxTS {
+			maxTS = ent.lock.startTS
+		}
+		return true
+	})
+	startTS, commitTS := maxTS+1, maxTS+2
+
+	ents := make([]*mvccEntry, 0, len(pairs))
+	for _, p := range pairs {
+		ent := s.getOrNewEntry(NewMvccKey(p.Key))
+		if ent.lock != nil {
+			return 0, errors.Trace(ent.lockErr())
+		}
+		if err := ent.checkVersionCount(s.maxVersionsPerKey); err != nil {
+			return 0, errors.Trace(err)
+		}
+		ent.addValue(mvccValue{
+			valueType: typePut,
+			startTS:   startTS,
+			commitTS:  commitTS,
+			value:     p.Value,
+		})
+		ents = append(ents, ent)
 	}
 	s.submit(ents...)
-	return nil
+	return commitTS, nil
 }
 
 // DeleteRange deletes all keys in [startKey, endKey).
 func (s *MvccStore) DeleteRange(startKey, endKey []byte) error {
+	if err := validateRange(startKey, endKey); err != nil {
+		return errors.Trace(err)
+	}
 	s.Lock()
 	defer s.Unlock()
 
@@ -586,6 +2422,86 @@ func (s *MvccStore) DeleteRange(startKey, endKey []byte) error {
 	return nil
 }
 
+// gcBatchSize is the max number of entries GCRange handles while holding the
+// lock of the store.
+const gcBatchSize = 256
+
+// GCRange removes the versions in [startKey, endKey) that are not visible to
+// any reader at or after safePoint, the same as TiKV's GC. The range is handled
+// in batches of gcBatchSize entries, each of them is written before the next
+// one is started, so other requests are not blocked for long. progress is
+// called after each batch with the total number of keys processed. GCRange
+// stops and returns the error of ctx when ctx is done, the batches handled
+// before are kept. The removed versions are recorded for LastGCDeletions.
+func (s *MvccStore) GCRange(ctx goctx.Context, startKey, endKey []byte, safePoint uint64, progress func(keysProcessed int)) error {
+	if err := validateRange(startKey, endKey); err != nil {
+		return errors.Trace(err)
+	}
+	s.Lock()
+	s.gcDeletions = nil
+	s.Unlock()
+	var processed int
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		default:
+		}
+		n, nextKey := s.gcBatch(startKey, endKey, safePoint)
+		processed += n
+		if progress != nil {
+			progress(processed)
+		}
+		if nextKey == nil {
+			return nil
+		}
+		startKey = nextKey
+	}
+}
+
+// gcBatch runs GC on at most gcBatchSize entries from startKey. It returns the
+// number of entries handled and the key to continue from, which is nil if the
+// range is finished.
+func (s *MvccStore) gcBatch(startKey, endKey []byte, safePoint uint64) (int, []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	var ents []*mvccEntry
+	var nextKey []byte
+	iterator := func(item llrb.Item) bool {
+		ent := item.(*mvccEntry)
+		if !regionContains(startKey, endKey, ent.key) {
+			return false
+		}
+		if len(ents) >= gcBatchSize {
+			nextKey = ent.key
+			return false
+		}
+		ents = append(ents, ent)
+		return true
+	}
+	s.tree.AscendGreaterOrEqual(newEntry(startKey), iterator)
+	for _, ent := range ents {
+		ent = ent.Clone()
+		removed := ent.gc(safePoint)
+		if len(removed) == 0 {
+			continue
+		}
+		for _, v := range removed {
+			if len(s.gcDeletions) >= s.gcDeletionLimit {
+				break
+			}
+			s.gcDeletions = append(s.gcDeletions, DeletedVersion{Key: ent.key.Raw(), StartTS: v.startTS, CommitTS: v.commitTS})
+		}
+		if len(ent.values) == 0 && ent.lock == nil {
+			s.tree.Delete(ent)
+		} else {
+			s.submit(ent)
+		}
+	}
+	return len(ents), nextKey
+}
+
 // RawGet queries value with the key.
 func (s *MvccStore) RawGet(key []byte) []byte {
 	s.RLock()
@@ -625,6 +2541,9 @@ func (s *MvccStore) RawDelete(key []byte) {
 
 // RawScan reads up to a limited number of rawkv Pairs.
 func (s *MvccStore) RawScan(startKey, endKey []byte, limit int) []Pair {
+	if err := validateRange(startKey, endKey); err != nil {
+		return []Pair{{Err: err}}
+	}
 	s.RLock()
 	defer s.RUnlock()
 
@@ -46,6 +46,11 @@ func convertToKeyError(err error) *kvrpcpb.KeyError {
 			},
 		}
 	}
+	if conflict, ok := err.(*ErrWriteConflict); ok {
+		return &kvrpcpb.KeyError{
+			Retryable: conflict.Error(),
+		}
+	}
 	if retryable, ok := err.(ErrRetryable); ok {
 		return &kvrpcpb.KeyError{
 			Retryable: retryable.Error(),
@@ -15,12 +15,15 @@ package tikv
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/etcd/pkg/monotime"
 	"github.com/juju/errors"
 	"github.com/ngaut/log"
+	pb "github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/terror"
 	"github.com/pingcap/tipb/go-binlog"
 	goctx "golang.org/x/net/context"
 )
@@ -36,12 +39,42 @@ type tikvTxn struct {
 	store     *tikvStore // for connection to region.
 	startTS   uint64
 	startTime monotime.Time // Monotonic timestamp for recording txn time consuming.
+	closeTime monotime.Time // Monotonic timestamp when the txn is committed or rolled back.
 	commitTS  uint64
 	valid     bool
 	lockKeys  [][]byte
 	dirty     bool
+	// preCommitValidator checks the mutations before prewrite, a non-nil error
+	// aborts the commit.
+	preCommitValidator func(mutations []*pb.Mutation) error
+	// committer and phase track the commit steps called explicitly by
+	// Prewrite, GetCommitTS, CommitPrimary and CommitSecondaries.
+	committer *twoPhaseCommitter
+	phase     commitPhase
+	// retryCount is the number of prewrite retries in the last commit.
+	retryCount int
+	// savepoints are set by SetSavepoint, from the earliest to the latest.
+	savepoints []txnSavepoint
 }
 
+// txnSavepoint is the state of the transaction at a savepoint: a checkpoint of
+// the union store, the number of locked keys and the dirty flag.
+type txnSavepoint struct {
+	name     string
+	cp       kv.UnionStoreCheckpoint
+	lockKeys int
+	dirty    bool
+}
+
+type commitPhase int
+
+const (
+	phaseNone commitPhase = iota
+	phasePrewritten
+	phaseCommitTSFetched
+	phasePrimaryCommitted
+)
+
 func newTiKVTxn(store *tikvStore) (*tikvTxn, error) {
 	bo := NewBackoffer(tsoMaxBackoff, goctx.Background())
 	startTS, err := store.getTimestampWithRetry(bo)
@@ -71,6 +104,9 @@ func (txn *tikvTxn) Get(k kv.Key) ([]byte, error) {
 	start := time.Now()
 	defer func() { txnCmdHistogram.WithLabelValues("get").Observe(time.Since(start).Seconds()) }()
 
+	if err := txn.checkMaxExecTime(); err != nil {
+		return nil, errors.Trace(err)
+	}
 	ret, err := txn.us.Get(k)
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -78,15 +114,110 @@ func (txn *tikvTxn) Get(k kv.Key) ([]byte, error) {
 	return ret, nil
 }
 
+// BatchGet gets the values of keys and returns a map which doesn't contain
+// nonexistent keys. The buffered writes of the transaction are read first, the
+// other keys are read from the snapshot in batches.
+func (txn *tikvTxn) BatchGet(keys []kv.Key) (map[string][]byte, error) {
+	if err := txn.checkMaxExecTime(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !txn.dirty {
+		m, err := txn.snapshot.BatchGet(keys)
+		return m, errors.Trace(err)
+	}
+
+	buffered := make(map[string][]byte)
+	var unbuffered []kv.Key
+	for _, k := range keys {
+		v, err := txn.us.GetMemBuffer().Get(k)
+		if kv.IsErrNotFound(err) {
+			unbuffered = append(unbuffered, k)
+			continue
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		buffered[string(k)] = v
+	}
+	m, err := txn.snapshot.BatchGet(unbuffered)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for k, v := range buffered {
+		// An empty buffered value means the key is deleted.
+		if len(v) > 0 {
+			m[k] = v
+		}
+	}
+	return m, nil
+}
+
+// GetWithIsolation is like Get, but reads from the snapshot with the isolation
+// level for this call only. The isolation level of the transaction is not
+// changed.
+func (txn *tikvTxn) GetWithIsolation(k kv.Key, level kv.IsoLevel) ([]byte, error) {
+	prev := txn.snapshot.isolationLevel
+	txn.snapshot.isolationLevel = level
+	defer func() { txn.snapshot.isolationLevel = prev }()
+	return txn.Get(k)
+}
+
+// GetForUpdate reads the key like `SELECT ... FOR UPDATE`: it reads the value
+// at startTS and adds the key to the lock set, so that the key is locked when
+// the transaction prewrites. The commit fails if the key is written by others
+// after startTS. The buffered write of the key is still read first.
+func (txn *tikvTxn) GetForUpdate(k kv.Key) ([]byte, error) {
+	val, err := txn.Get(k)
+	if err != nil && !kv.IsErrNotFound(err) {
+		return nil, errors.Trace(err)
+	}
+	if lockErr := txn.LockKeys(k); lockErr != nil {
+		return nil, errors.Trace(lockErr)
+	}
+	return val, errors.Trace(err)
+}
+
 func (txn *tikvTxn) Set(k kv.Key, v []byte) error {
 	txnCmdCounter.WithLabelValues("set").Inc()
 
+	if err := txn.checkMaxExecTime(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := txn.checkMemBufferLimit(k, v); err != nil {
+		return errors.Trace(err)
+	}
 	txn.dirty = true
 	return txn.us.Set(k, v)
 }
 
+// checkMemBufferLimit returns ErrTxnTooLarge if writing k and v would make the
+// membuffer exceed the limits set by kv.MemBufferLimit or kv.MemBufferEntryLimit.
+func (txn *tikvTxn) checkMemBufferLimit(k kv.Key, v []byte) error {
+	if limit, ok := txn.us.GetOption(kv.MemBufferLimit).(int); ok {
+		if size := txn.Size() + len(k) + len(v); size > limit {
+			log.Warnf("[kv] txn %d membuffer size %d exceeds limit %d", txn.StartTS(), size, limit)
+			return kv.ErrTxnTooLarge
+		}
+	}
+	if limit, ok := txn.us.GetOption(kv.MemBufferEntryLimit).(int); ok && txn.Len()+1 > limit {
+		log.Warnf("[kv] txn %d membuffer entries %d exceeds limit %d", txn.StartTS(), txn.Len()+1, limit)
+		return kv.ErrTxnTooLarge
+	}
+	return nil
+}
+
 func (txn *tikvTxn) String() string {
-	return fmt.Sprintf("%d", txn.StartTS())
+	return fmt.Sprintf("%d, duration: %v", txn.StartTS(), txn.Duration())
+}
+
+// Duration returns the time elapsed since the transaction is created. For a
+// committed or rolled back transaction, it is the lifetime of the transaction.
+func (txn *tikvTxn) Duration() time.Duration {
+	end := txn.closeTime
+	if end == 0 {
+		end = monotime.Now()
+	}
+	return time.Duration(end - txn.startTime)
 }
 
 func (txn *tikvTxn) Seek(k kv.Key) (kv.Iterator, error) {
@@ -94,6 +225,9 @@ func (txn *tikvTxn) Seek(k kv.Key) (kv.Iterator, error) {
 	start := time.Now()
 	defer func() { txnCmdHistogram.WithLabelValues("seek").Observe(time.Since(start).Seconds()) }()
 
+	if err := txn.checkMaxExecTime(); err != nil {
+		return nil, errors.Trace(err)
+	}
 	return txn.us.Seek(k)
 }
 
@@ -103,17 +237,41 @@ func (txn *tikvTxn) SeekReverse(k kv.Key) (kv.Iterator, error) {
 	start := time.Now()
 	defer func() { txnCmdHistogram.WithLabelValues("seek_reverse").Observe(time.Since(start).Seconds()) }()
 
+	if err := txn.checkMaxExecTime(); err != nil {
+		return nil, errors.Trace(err)
+	}
 	return txn.us.SeekReverse(k)
 }
 
+// checkMaxExecTime returns ErrMaxExecTimeExceeded if the transaction has run
+// longer than the time set by kv.MaxExecutionTime.
+func (txn *tikvTxn) checkMaxExecTime() error {
+	if limit, ok := txn.us.GetOption(kv.MaxExecutionTime).(time.Duration); ok && limit > 0 && txn.Duration() > limit {
+		log.Warnf("[kv] txn %d runs %v, exceeds max execution time %v", txn.StartTS(), txn.Duration(), limit)
+		return kv.ErrMaxExecTimeExceeded
+	}
+	return nil
+}
+
 func (txn *tikvTxn) Delete(k kv.Key) error {
 	txnCmdCounter.WithLabelValues("delete").Inc()
 
+	if err := txn.checkMaxExecTime(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := txn.checkMemBufferLimit(k, nil); err != nil {
+		return errors.Trace(err)
+	}
 	txn.dirty = true
 	return txn.us.Delete(k)
 }
 
+// SetOption sets an option of the transaction. It panics on an invalid priority,
+// which can't be mapped to a command priority of TiKV.
 func (txn *tikvTxn) SetOption(opt kv.Option, val interface{}) {
+	if opt == kv.Priority && !isValidPriority(val) {
+		panic(fmt.Sprintf("invalid priority %v, txn %d", val, txn.StartTS()))
+	}
 	txn.us.SetOption(opt, val)
 	switch opt {
 	case kv.IsolationLevel:
@@ -123,6 +281,26 @@ func (txn *tikvTxn) SetOption(opt kv.Option, val interface{}) {
 	}
 }
 
+func isValidPriority(val interface{}) bool {
+	pri, ok := val.(int)
+	if !ok {
+		return false
+	}
+	switch pri {
+	case kv.PriorityNormal, kv.PriorityLow, kv.PriorityHigh:
+		return true
+	}
+	return false
+}
+
+// Priority returns the priority of the transaction, see kv.Priority.
+func (txn *tikvTxn) Priority() int {
+	if pri, ok := txn.us.GetOption(kv.Priority).(int); ok {
+		return pri
+	}
+	return kv.PriorityNormal
+}
+
 func (txn *tikvTxn) DelOption(opt kv.Option) {
 	txn.us.DelOption(opt)
 	if opt == kv.IsolationLevel {
@@ -131,38 +309,221 @@ func (txn *tikvTxn) DelOption(opt kv.Option) {
 }
 
 func (txn *tikvTxn) Commit() error {
+	return txn.CommitWithContext(goctx.Background())
+}
+
+// CommitWithContext commits the transaction. If ctx is canceled or its deadline
+// is exceeded before the primary key is committed, the commit is aborted and
+// the context's error is returned.
+func (txn *tikvTxn) CommitWithContext(ctx goctx.Context) error {
 	if !txn.valid {
 		return kv.ErrInvalidTxn
 	}
+	if txn.phase != phaseNone {
+		return errors.Trace(errCommitPhaseOrder)
+	}
 	defer txn.close()
 
 	txnCmdCounter.WithLabelValues("commit").Inc()
 	start := time.Now()
 	defer func() { txnCmdHistogram.WithLabelValues("commit").Observe(time.Since(start).Seconds()) }()
 
-	if err := txn.us.CheckLazyConditionPairs(); err != nil {
+	committer, err := txn.prepareCommit()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if committer == nil {
+		return nil
+	}
+	err = committer.execute(ctx)
+	txn.retryCount = int(atomic.LoadInt32(&committer.retryCount))
+	if err != nil {
+		committer.writeFinishBinlog(binlog.BinlogType_Rollback, 0)
 		return errors.Trace(err)
 	}
+	committer.writeFinishBinlog(binlog.BinlogType_Commit, int64(committer.commitTS))
+	txn.commitTS = committer.commitTS
+	return nil
+}
 
+// prepareCommit checks the transaction before it is committed by Commit or
+// Prewrite, and creates the committer. The committer is nil if there is nothing
+// to commit.
+func (txn *tikvTxn) prepareCommit() (*twoPhaseCommitter, error) {
+	if err := txn.checkMaxExecTime(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if skip, ok := txn.us.GetOption(kv.SkipLazyCheck).(bool); !ok || !skip {
+		if err := txn.us.CheckLazyConditionPairs(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
 	committer, err := newTwoPhaseCommitter(txn)
+	return committer, errors.Trace(err)
+}
+
+// Prewrite runs the first phase of the commit explicitly: it prewrites all the
+// keys of the transaction. It must be followed by GetCommitTS, CommitPrimary
+// and CommitSecondaries in order. Commit runs all the phases at once and should
+// be used unless the caller needs to observe the state between the phases.
+func (txn *tikvTxn) Prewrite() error {
+	if !txn.valid {
+		return kv.ErrInvalidTxn
+	}
+	if txn.phase != phaseNone {
+		return errors.Trace(errCommitPhaseOrder)
+	}
+	committer, err := txn.prepareCommit()
 	if err != nil {
+		txn.close()
 		return errors.Trace(err)
 	}
+	txn.committer = committer
+	txn.phase = phasePrewritten
 	if committer == nil {
 		return nil
 	}
-	err = committer.execute()
+	committer.syncCommit = true
+	if err = committer.validateMutations(); err != nil {
+		txn.abortPhases()
+		return errors.Trace(err)
+	}
+	binlogChan := committer.prewriteBinlog()
+	err = committer.prewriteKeys(NewBackoffer(prewriteMaxBackoff, goctx.Background()), committer.keys)
+	txn.retryCount = int(atomic.LoadInt32(&committer.retryCount))
+	if binlogChan != nil {
+		if binlogErr := <-binlogChan; binlogErr != nil && err == nil {
+			err = binlogErr
+		}
+	}
 	if err != nil {
-		committer.writeFinishBinlog(binlog.BinlogType_Rollback, 0)
+		txn.abortPhases()
 		return errors.Trace(err)
 	}
-	committer.writeFinishBinlog(binlog.BinlogType_Commit, int64(committer.commitTS))
-	txn.commitTS = committer.commitTS
 	return nil
 }
 
+// GetCommitTS runs the second phase of the commit explicitly: it fetches the
+// commit ts after Prewrite. It returns 0 if the transaction has nothing to
+// commit. Like Prewrite and CommitPrimary, it aborts the transaction if it has
+// run longer than kv.MaxExecutionTime.
+func (txn *tikvTxn) GetCommitTS() (uint64, error) {
+	if !txn.valid {
+		return 0, kv.ErrInvalidTxn
+	}
+	if txn.phase != phasePrewritten {
+		return 0, errors.Trace(errCommitPhaseOrder)
+	}
+	txn.phase = phaseCommitTSFetched
+	if txn.committer == nil {
+		return 0, nil
+	}
+	if err := txn.checkMaxExecTime(); err != nil {
+		txn.abortPhases()
+		return 0, errors.Trace(err)
+	}
+	if err := txn.committer.getCommitTS(goctx.Background()); err != nil {
+		txn.abortPhases()
+		return 0, errors.Trace(err)
+	}
+	return txn.committer.commitTS, nil
+}
+
+// CommitPrimary runs the third phase of the commit explicitly: it commits the
+// primary key after GetCommitTS. The transaction is committed once it succeeds.
+func (txn *tikvTxn) CommitPrimary() error {
+	if !txn.valid {
+		return kv.ErrInvalidTxn
+	}
+	if txn.phase != phaseCommitTSFetched {
+		return errors.Trace(errCommitPhaseOrder)
+	}
+	txn.phase = phasePrimaryCommitted
+	c := txn.committer
+	if c == nil {
+		return nil
+	}
+	if err := txn.checkMaxExecTime(); err != nil {
+		txn.abortPhases()
+		return errors.Trace(err)
+	}
+	err := c.commitKeys(NewBackoffer(commitMaxBackoff, goctx.Background()), c.keys[:1])
+	if err != nil {
+		if errors.Cause(err) == terror.ErrResultUndetermined {
+			c.mu.undetermined = true
+		}
+		if !c.mu.committed {
+			if !c.mu.undetermined {
+				txn.abortPhases()
+			} else {
+				txn.close()
+			}
+			return errors.Trace(err)
+		}
+	}
+	txn.commitTS = c.commitTS
+	return nil
+}
+
+// CommitSecondaries runs the last phase of the commit explicitly: it commits the
+// secondary keys after CommitPrimary and finishes the transaction. Secondary
+// keys that fail to be committed are left locked and will be resolved by
+// readers, since the transaction is already committed.
+func (txn *tikvTxn) CommitSecondaries() error {
+	if !txn.valid {
+		return kv.ErrInvalidTxn
+	}
+	if txn.phase != phasePrimaryCommitted {
+		return errors.Trace(errCommitPhaseOrder)
+	}
+	defer txn.close()
+	c := txn.committer
+	if c == nil {
+		return nil
+	}
+	err := c.commitKeys(NewBackoffer(commitMaxBackoff, goctx.Background()), c.keys[1:])
+	c.writeFinishBinlog(binlog.BinlogType_Commit, int64(c.commitTS))
+	return errors.Trace(err)
+}
+
+// abortPhases cleans up the keys written by the explicit commit phases and
+// closes the transaction.
+func (txn *tikvTxn) abortPhases() {
+	defer txn.close()
+	c := txn.committer
+	c.mu.RLock()
+	writtenKeys := c.mu.writtenKeys
+	c.mu.RUnlock()
+	err := c.cleanupKeys(NewBackoffer(cleanupMaxBackoff, goctx.Background()), writtenKeys)
+	if err != nil {
+		log.Infof("2PC cleanup err: %v, tid: %d", err, c.startTS)
+	}
+	c.writeFinishBinlog(binlog.BinlogType_Rollback, 0)
+}
+
+// CommitTS returns the commit timestamp of the transaction after it's
+// committed successfully. It returns 0 if the transaction is not committed or
+// has nothing to commit.
+func (txn *tikvTxn) CommitTS() uint64 {
+	return txn.commitTS
+}
+
+// RetryCount returns how many times the prewrite requests were retried during
+// Commit because they met locks or region errors.
+func (txn *tikvTxn) RetryCount() int {
+	return txn.retryCount
+}
+
+// SetPreCommitValidator sets a function to inspect all the mutations of the
+// transaction before prewrite. If it returns an error, the commit is aborted
+// without writing anything to the store.
+func (txn *tikvTxn) SetPreCommitValidator(fn func(mutations []*pb.Mutation) error) {
+	txn.preCommitValidator = fn
+}
+
 func (txn *tikvTxn) close() error {
 	txn.valid = false
+	txn.closeTime = monotime.Now()
 	return nil
 }
 
@@ -170,6 +531,10 @@ func (txn *tikvTxn) Rollback() error {
 	if !txn.valid {
 		return kv.ErrInvalidTxn
 	}
+	if txn.committer != nil && txn.phase < phasePrimaryCommitted {
+		// Clean up the locks written by Prewrite.
+		txn.abortPhases()
+	}
 	txn.close()
 	log.Infof("[kv] Rollback txn %d", txn.StartTS())
 	txnCmdCounter.WithLabelValues("rollback").Inc()
@@ -193,6 +558,13 @@ func (txn *tikvTxn) StartTS() uint64 {
 	return txn.startTS
 }
 
+// GetSnapshot returns the snapshot the transaction reads from. It shares the
+// transaction's startTS and options, reading from it never sees the
+// transaction's own mutations.
+func (txn *tikvTxn) GetSnapshot() kv.Snapshot {
+	return txn.snapshot
+}
+
 func (txn *tikvTxn) Valid() bool {
 	return txn.valid
 }
@@ -204,3 +576,75 @@ func (txn *tikvTxn) Len() int {
 func (txn *tikvTxn) Size() int {
 	return txn.us.Size()
 }
+
+// WalkBuffer calls fn for each key set or deleted by the transaction in key
+// order, which are the mutations to be committed. A deleted key is passed with
+// an empty value.
+func (txn *tikvTxn) WalkBuffer(fn func(k kv.Key, v []byte) error) error {
+	return errors.Trace(txn.us.WalkBuffer(fn))
+}
+
+// SetSavepoint saves the state of the transaction as a savepoint named name,
+// which replaces the previous savepoint of the same name. The name must not be
+// empty.
+func (txn *tikvTxn) SetSavepoint(name string) error {
+	if !txn.valid {
+		return kv.ErrInvalidTxn
+	}
+	if name == "" {
+		return errors.Trace(errEmptySavepointName)
+	}
+	sp := txnSavepoint{
+		name:     name,
+		cp:       txn.us.SaveCheckpoint(),
+		lockKeys: len(txn.lockKeys),
+		dirty:    txn.dirty,
+	}
+	for i := range txn.savepoints {
+		if txn.savepoints[i].name == name {
+			txn.savepoints = append(txn.savepoints[:i], txn.savepoints[i+1:]...)
+			break
+		}
+	}
+	txn.savepoints = append(txn.savepoints, sp)
+	return nil
+}
+
+// RollbackToSavepoint discards the mutations, locked keys and lazy checks made
+// after the savepoint named name, and the savepoints set after it. The
+// savepoint itself is kept, so it can be rolled back to again.
+func (txn *tikvTxn) RollbackToSavepoint(name string) error {
+	i := len(txn.savepoints) - 1
+	for i >= 0 && txn.savepoints[i].name != name {
+		i--
+	}
+	if i < 0 {
+		return errors.Annotatef(errSavepointNotExist, "savepoint %s", name)
+	}
+	sp := txn.savepoints[i]
+	if err := txn.us.RestoreCheckpoint(sp.cp); err != nil {
+		return errors.Trace(err)
+	}
+	txn.savepoints = txn.savepoints[:i+1]
+	txn.lockKeys = txn.lockKeys[:sp.lockKeys]
+	txn.dirty = sp.dirty
+	return nil
+}
+
+// MutationCount returns the numbers of keys set and deleted by the transaction.
+// It counts the net state of each key, so a key set and then deleted is counted
+// as a delete.
+func (txn *tikvTxn) MutationCount() (sets int, deletes int) {
+	err := txn.WalkBuffer(func(k kv.Key, v []byte) error {
+		if len(v) == 0 {
+			deletes++
+		} else {
+			sets++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("[kv] count mutations of txn %d error: %v", txn.StartTS(), err)
+	}
+	return sets, deletes
+}
@@ -0,0 +1,786 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/pkg/monotime"
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	pb "github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/store/tikv/mock-tikv"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"github.com/pingcap/tidb/store/tikv/tikvrpc"
+	"github.com/pingcap/tidb/terror"
+	goctx "golang.org/x/net/context"
+)
+
+type testTxnSuite struct {
+	cluster   *mocktikv.Cluster
+	mvccStore *mocktikv.MvccStore
+	store     *tikvStore
+}
+
+var _ = Suite(&testTxnSuite{})
+
+func (s *testTxnSuite) SetUpTest(c *C) {
+	s.cluster = mocktikv.NewCluster()
+	mocktikv.BootstrapWithSingleStore(s.cluster)
+	s.mvccStore = mocktikv.NewMvccStore()
+	client := mocktikv.NewRPCClient(s.cluster, s.mvccStore)
+	pdCli := &codecPDClient{mocktikv.NewPDClient(s.cluster)}
+	store, err := newTikvStore("mock-tikv-store", pdCli, client, false)
+	c.Assert(err, IsNil)
+	s.store = store
+}
+
+func (s *testTxnSuite) TearDownTest(c *C) {
+	s.store.Close()
+}
+
+func (s *testTxnSuite) begin(c *C) *tikvTxn {
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	return txn.(*tikvTxn)
+}
+
+func (s *testTxnSuite) mustPut(c *C, key, value string) {
+	txn := s.begin(c)
+	c.Assert(txn.Set([]byte(key), []byte(value)), IsNil)
+	c.Assert(txn.Commit(), IsNil)
+}
+
+func (s *testTxnSuite) TestSkipLazyCheck(c *C) {
+	s.mustPut(c, "key", "value")
+
+	// The lazy check finds "key" exists and fails the commit by default.
+	txn := s.begin(c)
+	txn.SetOption(kv.PresumeKeyNotExists, nil)
+	_, err := txn.Get([]byte("key"))
+	c.Assert(terror.ErrorEqual(err, kv.ErrNotExist), IsTrue)
+	c.Assert(txn.Set([]byte("key"), []byte("value1")), IsNil)
+	err = txn.Commit()
+	c.Assert(terror.ErrorEqual(err, kv.ErrKeyExists), IsTrue)
+
+	txn = s.begin(c)
+	txn.SetOption(kv.PresumeKeyNotExists, nil)
+	txn.SetOption(kv.SkipLazyCheck, true)
+	_, err = txn.Get([]byte("key"))
+	c.Assert(terror.ErrorEqual(err, kv.ErrNotExist), IsTrue)
+	c.Assert(txn.Set([]byte("key"), []byte("value2")), IsNil)
+	c.Assert(txn.Commit(), IsNil)
+
+	txn = s.begin(c)
+	val, err := txn.Get([]byte("key"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "value2")
+}
+
+func (s *testTxnSuite) TestPreCommitValidator(c *C) {
+	errRejected := errors.New("mutation rejected")
+	var validated []*pb.Mutation
+	validator := func(mutations []*pb.Mutation) error {
+		validated = mutations
+		for _, m := range mutations {
+			if bytes.Equal(m.Key, []byte("b")) {
+				return errRejected
+			}
+		}
+		return nil
+	}
+
+	txn := s.begin(c)
+	txn.SetPreCommitValidator(validator)
+	c.Assert(txn.Set([]byte("a"), []byte("a")), IsNil)
+	c.Assert(txn.Delete([]byte("b")), IsNil)
+	err := txn.Commit()
+	c.Assert(errors.Cause(err), Equals, errRejected)
+	c.Assert(validated, HasLen, 2)
+
+	locks, err := s.mvccStore.ScanLock(nil, nil, math.MaxUint64)
+	c.Assert(err, IsNil)
+	c.Assert(locks, HasLen, 0)
+	txn = s.begin(c)
+	_, err = txn.Get([]byte("a"))
+	c.Assert(terror.ErrorEqual(err, kv.ErrNotExist), IsTrue)
+
+	txn = s.begin(c)
+	txn.SetPreCommitValidator(validator)
+	c.Assert(txn.Set([]byte("a"), []byte("a")), IsNil)
+	c.Assert(txn.Commit(), IsNil)
+	c.Assert(validated, HasLen, 1)
+	c.Assert(validated[0].Op, Equals, pb.Op_Put)
+}
+
+func (s *testTxnSuite) TestDuration(c *C) {
+	txn := s.begin(c)
+	txn.startTime = monotime.Now() - monotime.Time(time.Minute)
+	d := txn.Duration()
+	c.Assert(d >= time.Minute && d < 2*time.Minute, IsTrue)
+	c.Assert(strings.Contains(txn.String(), "duration: 1m"), IsTrue)
+
+	c.Assert(txn.Set([]byte("a"), []byte("a")), IsNil)
+	c.Assert(txn.Commit(), IsNil)
+	// The lifetime of a committed txn doesn't grow.
+	d = txn.Duration()
+	time.Sleep(time.Millisecond)
+	c.Assert(txn.Duration(), Equals, d)
+
+	txn = s.begin(c)
+	txn.startTime = monotime.Now() - monotime.Time(time.Second)
+	c.Assert(txn.Rollback(), IsNil)
+	d = txn.Duration()
+	c.Assert(d >= time.Second && d < time.Minute, IsTrue)
+}
+
+func (s *testTxnSuite) TestGetSnapshot(c *C) {
+	s.mustPut(c, "a", "a1")
+
+	txn := s.begin(c)
+	txn.SetOption(kv.IsolationLevel, kv.RC)
+	c.Assert(txn.Set([]byte("a"), []byte("a2")), IsNil)
+	snapshot := txn.GetSnapshot().(*tikvSnapshot)
+	c.Assert(snapshot.version.Ver, Equals, txn.StartTS())
+	c.Assert(snapshot.isolationLevel, Equals, kv.RC)
+	// The snapshot doesn't see the txn's mutations.
+	val, err := snapshot.Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a1")
+
+	txn.DelOption(kv.IsolationLevel)
+	c.Assert(txn.GetSnapshot().(*tikvSnapshot).isolationLevel, Equals, kv.SI)
+}
+
+func (s *testTxnSuite) TestGetRetryOnStaleRegionCache(c *C) {
+	s.mustPut(c, "a", "a1")
+	s.mustPut(c, "c", "c1")
+
+	// Move the leader to a new peer, the cached leader becomes stale.
+	region, _ := s.cluster.GetRegionByKey([]byte("a"))
+	ids := s.cluster.AllocIDs(2)
+	newStoreID, newPeerID := ids[0], ids[1]
+	s.cluster.AddStore(newStoreID, fmt.Sprintf("store%d", newStoreID))
+	s.cluster.AddPeer(region.GetId(), newStoreID, newPeerID)
+	s.cluster.ChangeLeader(region.GetId(), newPeerID)
+	val, err := s.begin(c).GetSnapshot().Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a1")
+
+	// Split the region, the cached region epoch becomes stale.
+	ids = s.cluster.AllocIDs(3)
+	s.cluster.Split(region.GetId(), ids[0], []byte("b"), []uint64{ids[1], ids[2]}, ids[2])
+	val, err = s.begin(c).GetSnapshot().Get([]byte("c"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "c1")
+}
+
+func (s *testTxnSuite) lockedKeys(c *C) []string {
+	locks, err := s.mvccStore.ScanLock(nil, nil, math.MaxUint64)
+	c.Assert(err, IsNil)
+	var keys []string
+	for _, l := range locks {
+		keys = append(keys, string(l.Key))
+	}
+	return keys
+}
+
+func (s *testTxnSuite) TestCommitPhases(c *C) {
+	txn := s.begin(c)
+	c.Assert(txn.Set([]byte("a"), []byte("a1")), IsNil)
+	c.Assert(txn.Set([]byte("b"), []byte("b1")), IsNil)
+	c.Assert(txn.Set([]byte("c"), []byte("c1")), IsNil)
+
+	// Phases can't be called out of order.
+	c.Assert(txn.CommitPrimary(), NotNil)
+	_, err := txn.GetCommitTS()
+	c.Assert(err, NotNil)
+
+	c.Assert(txn.Prewrite(), IsNil)
+	c.Assert(s.lockedKeys(c), DeepEquals, []string{"a", "b", "c"})
+	c.Assert(txn.Prewrite(), NotNil)
+	c.Assert(txn.Commit(), NotNil)
+
+	commitTS, err := txn.GetCommitTS()
+	c.Assert(err, IsNil)
+	c.Assert(commitTS > txn.StartTS(), IsTrue)
+	c.Assert(txn.CommitSecondaries(), NotNil)
+
+	c.Assert(txn.CommitPrimary(), IsNil)
+	c.Assert(txn.commitTS, Equals, commitTS)
+	primary := string(txn.committer.primary())
+	var secondaries []string
+	for _, k := range []string{"a", "b", "c"} {
+		if k != primary {
+			secondaries = append(secondaries, k)
+		}
+	}
+	c.Assert(s.lockedKeys(c), DeepEquals, secondaries)
+
+	c.Assert(txn.CommitSecondaries(), IsNil)
+	c.Assert(s.lockedKeys(c), HasLen, 0)
+	c.Assert(txn.Valid(), IsFalse)
+
+	txn = s.begin(c)
+	val, err := txn.Get([]byte("b"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "b1")
+}
+
+func (s *testTxnSuite) TestCommitPhasesRollback(c *C) {
+	txn := s.begin(c)
+	c.Assert(txn.Set([]byte("a"), []byte("a1")), IsNil)
+	c.Assert(txn.Set([]byte("b"), []byte("b1")), IsNil)
+	c.Assert(txn.Prewrite(), IsNil)
+	c.Assert(s.lockedKeys(c), HasLen, 2)
+
+	// Rolling back after prewrite cleans up the locks.
+	c.Assert(txn.Rollback(), IsNil)
+	c.Assert(s.lockedKeys(c), HasLen, 0)
+	_, err := s.begin(c).Get([]byte("a"))
+	c.Assert(terror.ErrorEqual(err, kv.ErrNotExist), IsTrue)
+}
+
+func (s *testTxnSuite) TestCommitPhasesMaxExecutionTime(c *C) {
+	txn := s.begin(c)
+	txn.SetOption(kv.MaxExecutionTime, 100*time.Millisecond)
+	c.Assert(txn.Set([]byte("a"), []byte("a1")), IsNil)
+	txn.startTime -= monotime.Time(time.Second)
+	err := txn.Prewrite()
+	c.Assert(kv.ErrMaxExecTimeExceeded.Equal(err), IsTrue)
+	c.Assert(txn.Valid(), IsFalse)
+
+	// The txn is aborted if it times out between the phases.
+	txn = s.begin(c)
+	txn.SetOption(kv.MaxExecutionTime, 100*time.Millisecond)
+	c.Assert(txn.Set([]byte("a"), []byte("a1")), IsNil)
+	c.Assert(txn.Prewrite(), IsNil)
+	_, err = txn.GetCommitTS()
+	c.Assert(err, IsNil)
+	txn.startTime -= monotime.Time(time.Second)
+	err = txn.CommitPrimary()
+	c.Assert(kv.ErrMaxExecTimeExceeded.Equal(err), IsTrue)
+	c.Assert(s.lockedKeys(c), HasLen, 0)
+	_, err = s.begin(c).Get([]byte("a"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+}
+
+// lockInjectClient writes a lock of an expired txn on the first key of each of
+// the first n prewrite requests, so that the requests meet locks and retry.
+type lockInjectClient struct {
+	Client
+	mvccStore *mocktikv.MvccStore
+	n         int
+	injected  int
+}
+
+func (c *lockInjectClient) SendReq(ctx goctx.Context, addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+	if req.Type == tikvrpc.CmdPrewrite && c.injected < c.n {
+		key := req.Prewrite.Mutations[0].Key
+		mutations := []*pb.Mutation{{Op: pb.Op_Put, Key: key, Value: key}}
+		c.injected++
+		c.mvccStore.Prewrite(mutations, key, oracle.ComposeTS(int64(c.injected), 0), 0)
+	}
+	return c.Client.SendReq(ctx, addr, req)
+}
+
+func (s *testTxnSuite) TestRetryCount(c *C) {
+	txn := s.begin(c)
+	c.Assert(txn.Set([]byte("b"), []byte("b1")), IsNil)
+	c.Assert(txn.Commit(), IsNil)
+	c.Assert(txn.RetryCount(), Equals, 0)
+
+	s.store.client = &lockInjectClient{Client: s.store.client, mvccStore: s.mvccStore, n: 3}
+	txn = s.begin(c)
+	c.Assert(txn.Set([]byte("a"), []byte("a2")), IsNil)
+	c.Assert(txn.Commit(), IsNil)
+	c.Assert(txn.RetryCount(), Equals, 3)
+	val, err := s.begin(c).Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a2")
+
+	// The explicit commit phases count the retries too.
+	s.store.client = &lockInjectClient{Client: s.store.client, mvccStore: s.mvccStore, n: 2}
+	txn = s.begin(c)
+	c.Assert(txn.Set([]byte("c"), []byte("c3")), IsNil)
+	c.Assert(txn.Prewrite(), IsNil)
+	c.Assert(txn.RetryCount(), Equals, 2)
+	c.Assert(txn.Rollback(), IsNil)
+}
+
+func (s *testTxnSuite) TestPriority(c *C) {
+	txn := s.begin(c)
+	c.Assert(txn.Priority(), Equals, kv.PriorityNormal)
+	for _, pri := range []int{kv.PriorityLow, kv.PriorityHigh, kv.PriorityNormal} {
+		txn.SetOption(kv.Priority, pri)
+		c.Assert(txn.Priority(), Equals, pri)
+		c.Assert(txn.snapshot.priority, Equals, kvPriorityToCommandPri(pri))
+	}
+
+	// Invalid values are rejected.
+	txn.SetOption(kv.Priority, kv.PriorityHigh)
+	for _, pri := range []interface{}{100, -1, "low"} {
+		c.Assert(func() { txn.SetOption(kv.Priority, pri) }, PanicMatches, "invalid priority .*")
+	}
+	c.Assert(txn.Priority(), Equals, kv.PriorityHigh)
+	c.Assert(txn.snapshot.priority, Equals, pb.CommandPri_High)
+}
+
+func (s *testTxnSuite) TestGetWithIsolation(c *C) {
+	s.mustPut(c, "a", "a1")
+	txn := s.begin(c)
+	// Another txn commits a newer version after txn starts, which is only
+	// visible under RC.
+	s.mustPut(c, "a", "a2")
+
+	val, err := txn.Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a1")
+	val, err = txn.GetWithIsolation([]byte("a"), kv.RC)
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a2")
+	c.Assert(txn.snapshot.isolationLevel, Equals, kv.SI)
+	val, err = txn.Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a1")
+
+	// The level set by SetOption is restored too.
+	txn.SetOption(kv.IsolationLevel, kv.RC)
+	val, err = txn.GetWithIsolation([]byte("a"), kv.SI)
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a1")
+	c.Assert(txn.snapshot.isolationLevel, Equals, kv.RC)
+
+	// Buffered writes are still read first.
+	c.Assert(txn.Set([]byte("a"), []byte("a3")), IsNil)
+	val, err = txn.GetWithIsolation([]byte("a"), kv.RC)
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a3")
+}
+
+func (s *testTxnSuite) TestGetForUpdate(c *C) {
+	s.mustPut(c, "a", "a1")
+	txn := s.begin(c)
+
+	val, err := txn.GetForUpdate([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a1")
+	c.Assert(txn.lockKeys, HasLen, 1)
+	c.Assert(string(txn.lockKeys[0]), Equals, "a")
+
+	// Keys not found are locked too.
+	_, err = txn.GetForUpdate([]byte("b"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+	c.Assert(txn.lockKeys, HasLen, 2)
+	c.Assert(string(txn.lockKeys[1]), Equals, "b")
+
+	// Buffered writes are still read first.
+	c.Assert(txn.Set([]byte("c"), []byte("c1")), IsNil)
+	val, err = txn.GetForUpdate([]byte("c"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "c1")
+	c.Assert(txn.Commit(), IsNil)
+
+	// The txn fails to commit if a key read for update is written after it
+	// starts.
+	txn = s.begin(c)
+	val, err = txn.GetForUpdate([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a1")
+	s.mustPut(c, "a", "a2")
+	c.Assert(txn.Set([]byte("d"), []byte("d1")), IsNil)
+	err = txn.Commit()
+	c.Assert(kv.IsRetryableError(err), IsTrue)
+	_, err = s.begin(c).Get([]byte("d"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+}
+
+func (s *testTxnSuite) TestCommitTS(c *C) {
+	txn := s.begin(c)
+	c.Assert(txn.Set([]byte("a"), []byte("a1")), IsNil)
+	c.Assert(txn.CommitTS(), Equals, uint64(0))
+	c.Assert(txn.Commit(), IsNil)
+	c.Assert(txn.CommitTS() > txn.StartTS(), IsTrue)
+
+	txn = s.begin(c)
+	c.Assert(txn.Set([]byte("a"), []byte("a2")), IsNil)
+	c.Assert(txn.Rollback(), IsNil)
+	c.Assert(txn.CommitTS(), Equals, uint64(0))
+
+	// A read-only txn commits nothing.
+	txn = s.begin(c)
+	c.Assert(txn.Commit(), IsNil)
+	c.Assert(txn.CommitTS(), Equals, uint64(0))
+}
+
+func (s *testTxnSuite) TestRunInNewTxn(c *C) {
+	s.mustPut(c, "a", "0")
+	// The first attempt conflicts with a txn committed after it starts.
+	attempts := 0
+	err := kv.RunInNewTxn(s.store, true, func(txn kv.Transaction) error {
+		attempts++
+		if attempts == 1 {
+			s.mustPut(c, "a", "1")
+		}
+		val, err := txn.Get([]byte("a"))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return txn.Set([]byte("a"), append(val, '+'))
+	})
+	c.Assert(err, IsNil)
+	c.Assert(attempts, Equals, 2)
+	val, err := s.begin(c).Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "1+")
+
+	// Other errors are not retried.
+	attempts = 0
+	err = kv.RunInNewTxn(s.store, true, func(txn kv.Transaction) error {
+		attempts++
+		return errors.New("permanent")
+	})
+	c.Assert(err, ErrorMatches, "permanent")
+	c.Assert(attempts, Equals, 1)
+}
+
+func (s *testTxnSuite) TestSeekReverse(c *C) {
+	s.mustPut(c, "a", "a1")
+	txn := s.begin(c)
+	// The scan request of TiKV can't scan backward yet.
+	_, err := txn.SeekReverse([]byte("b"))
+	c.Assert(terror.ErrorEqual(err, kv.ErrNotImplemented), IsTrue)
+}
+
+func (s *testTxnSuite) TestMemBufferLimit(c *C) {
+	txn := s.begin(c)
+	txn.SetOption(kv.MemBufferLimit, 10)
+	err := txn.Set([]byte("a"), []byte("0123456789"))
+	c.Assert(terror.ErrorEqual(err, kv.ErrTxnTooLarge), IsTrue)
+	c.Assert(txn.Len(), Equals, 0)
+	c.Assert(txn.Set([]byte("a"), []byte("012345678")), IsNil)
+	c.Assert(txn.Size(), Equals, 10)
+	err = txn.Set([]byte("b"), []byte("b"))
+	c.Assert(terror.ErrorEqual(err, kv.ErrTxnTooLarge), IsTrue)
+	err = txn.Delete([]byte("a"))
+	c.Assert(terror.ErrorEqual(err, kv.ErrTxnTooLarge), IsTrue)
+	c.Assert(txn.Len(), Equals, 1)
+	// Raising the limit allows writes again.
+	txn.SetOption(kv.MemBufferLimit, 100)
+	c.Assert(txn.Set([]byte("b"), []byte("b")), IsNil)
+
+	txn = s.begin(c)
+	txn.SetOption(kv.MemBufferEntryLimit, 2)
+	c.Assert(txn.Set([]byte("a"), []byte("a")), IsNil)
+	c.Assert(txn.Set([]byte("b"), []byte("b")), IsNil)
+	err = txn.Delete([]byte("c"))
+	c.Assert(terror.ErrorEqual(err, kv.ErrTxnTooLarge), IsTrue)
+	err = txn.Set([]byte("d"), []byte("d"))
+	c.Assert(terror.ErrorEqual(err, kv.ErrTxnTooLarge), IsTrue)
+	c.Assert(txn.Len(), Equals, 2)
+	txn.DelOption(kv.MemBufferEntryLimit)
+	c.Assert(txn.Set([]byte("d"), []byte("d")), IsNil)
+}
+
+func (s *testTxnSuite) TestBeginWithStartTS(c *C) {
+	s.mustPut(c, "a", "a1")
+	startTS := s.begin(c).StartTS()
+	s.mustPut(c, "a", "a2")
+
+	txn, err := s.store.BeginWithStartTS(startTS)
+	c.Assert(err, IsNil)
+	c.Assert(txn.StartTS(), Equals, startTS)
+	val, err := txn.Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a1")
+
+	_, err = s.store.BeginWithStartTS(0)
+	c.Assert(terror.ErrorEqual(err, errInvalidStartTS), IsTrue)
+}
+
+func (s *testTxnSuite) TestBeginWithExactStaleness(c *C) {
+	// Commit "a1" 10 seconds ago.
+	startTS := oracle.ComposeTS(oracle.GetPhysical(time.Now().Add(-10*time.Second)), 0)
+	mutations := []*pb.Mutation{{Op: pb.Op_Put, Key: []byte("a"), Value: []byte("a1")}}
+	c.Assert(s.mvccStore.Prewrite(mutations, []byte("a"), startTS, 0), DeepEquals, []error{nil})
+	c.Assert(s.mvccStore.Commit([][]byte{[]byte("a")}, startTS, startTS+1), IsNil)
+	s.mustPut(c, "a", "a2")
+
+	txn, err := s.store.BeginWithExactStaleness(5)
+	c.Assert(err, IsNil)
+	c.Assert(txn.StartTS() > startTS+1, IsTrue)
+	val, err := txn.Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a1")
+
+	txn, err = s.store.BeginWithExactStaleness(0)
+	c.Assert(err, IsNil)
+	val, err = txn.Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a2")
+}
+
+func (s *testTxnSuite) TestBatchGet(c *C) {
+	s.mustPut(c, "a", "a1")
+	s.mustPut(c, "b", "b1")
+	s.mustPut(c, "c", "c1")
+	keys := []kv.Key{kv.Key("a"), kv.Key("b"), kv.Key("c"), kv.Key("x"), kv.Key("y")}
+
+	txn := s.begin(c)
+	m, err := txn.BatchGet(keys)
+	c.Assert(err, IsNil)
+	c.Assert(m, DeepEquals, map[string][]byte{"a": []byte("a1"), "b": []byte("b1"), "c": []byte("c1")})
+
+	// Buffered writes are read first.
+	c.Assert(txn.Set([]byte("a"), []byte("a2")), IsNil)
+	c.Assert(txn.Delete([]byte("b")), IsNil)
+	c.Assert(txn.Set([]byte("x"), []byte("x2")), IsNil)
+	c.Assert(txn.Set([]byte("z"), []byte("z2")), IsNil)
+	m, err = txn.BatchGet(keys)
+	c.Assert(err, IsNil)
+	c.Assert(m, DeepEquals, map[string][]byte{"a": []byte("a2"), "c": []byte("c1"), "x": []byte("x2")})
+	_, ok := m["y"]
+	c.Assert(ok, IsFalse)
+}
+
+func (s *testTxnSuite) TestMutationCount(c *C) {
+	txn := s.begin(c)
+	sets, deletes := txn.MutationCount()
+	c.Assert(sets, Equals, 0)
+	c.Assert(deletes, Equals, 0)
+
+	c.Assert(txn.Set([]byte("a"), []byte("a1")), IsNil)
+	c.Assert(txn.Set([]byte("b"), []byte("b1")), IsNil)
+	c.Assert(txn.Set([]byte("a"), []byte("a2")), IsNil)
+	sets, deletes = txn.MutationCount()
+	c.Assert(sets, Equals, 2)
+	c.Assert(deletes, Equals, 0)
+
+	txn = s.begin(c)
+	c.Assert(txn.Delete([]byte("a")), IsNil)
+	c.Assert(txn.Delete([]byte("b")), IsNil)
+	sets, deletes = txn.MutationCount()
+	c.Assert(sets, Equals, 0)
+	c.Assert(deletes, Equals, 2)
+
+	// The net state of each key is counted.
+	txn = s.begin(c)
+	c.Assert(txn.Set([]byte("a"), []byte("a1")), IsNil)
+	c.Assert(txn.Delete([]byte("a")), IsNil)
+	c.Assert(txn.Delete([]byte("b")), IsNil)
+	c.Assert(txn.Set([]byte("b"), []byte("b1")), IsNil)
+	c.Assert(txn.Set([]byte("c"), []byte("c1")), IsNil)
+	sets, deletes = txn.MutationCount()
+	c.Assert(sets, Equals, 2)
+	c.Assert(deletes, Equals, 1)
+}
+
+func (s *testTxnSuite) TestWalkBuffer(c *C) {
+	s.mustPut(c, "x", "x0")
+	txn := s.begin(c)
+	c.Assert(txn.Set([]byte("c"), []byte("c1")), IsNil)
+	c.Assert(txn.Delete([]byte("b")), IsNil)
+	c.Assert(txn.Set([]byte("a"), []byte("a1")), IsNil)
+	c.Assert(txn.Set([]byte("b"), []byte("b1")), IsNil)
+	c.Assert(txn.Delete([]byte("x")), IsNil)
+	_, err := txn.Get([]byte("x"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+
+	var walked []string
+	err = txn.WalkBuffer(func(k kv.Key, v []byte) error {
+		walked = append(walked, string(k)+"="+string(v))
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(walked, DeepEquals, []string{"a=a1", "b=b1", "c=c1", "x="})
+
+	// The walk stops at the error of fn.
+	walked = nil
+	errStop := errors.New("stop")
+	err = txn.WalkBuffer(func(k kv.Key, v []byte) error {
+		walked = append(walked, string(k))
+		if len(walked) == 2 {
+			return errStop
+		}
+		return nil
+	})
+	c.Assert(errors.Cause(err), Equals, errStop)
+	c.Assert(walked, DeepEquals, []string{"a", "b"})
+
+	// Walking doesn't change what is committed.
+	c.Assert(txn.Commit(), IsNil)
+	val, err := s.begin(c).Get([]byte("b"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "b1")
+	_, err = s.begin(c).Get([]byte("x"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+}
+
+func (s *testTxnSuite) TestPrewriteFailpoint(c *C) {
+	// A retryable prewrite error fails the txn with a retryable error, and
+	// kv.RunInNewTxn retries it.
+	var failures int
+	s.mvccStore.SetFailpoint("prewrite", func() error {
+		if failures > 0 {
+			failures--
+			return mocktikv.ErrRetryable("injected")
+		}
+		return nil
+	})
+	defer s.mvccStore.SetFailpoint("prewrite", nil)
+
+	failures = 1
+	txn := s.begin(c)
+	c.Assert(txn.Set([]byte("a"), []byte("1")), IsNil)
+	err := txn.Commit()
+	c.Assert(kv.IsRetryableError(err), IsTrue)
+	_, err = s.begin(c).Get([]byte("a"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+
+	failures = 1
+	attempts := 0
+	err = kv.RunInNewTxn(s.store, true, func(txn kv.Transaction) error {
+		attempts++
+		return txn.Set([]byte("a"), []byte("2"))
+	})
+	c.Assert(err, IsNil)
+	c.Assert(attempts, Equals, 2)
+	val, err := s.begin(c).Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "2")
+
+	// An abort error is not retryable.
+	s.mvccStore.SetFailpoint("prewrite", func() error { return mocktikv.ErrAbort("injected") })
+	txn = s.begin(c)
+	c.Assert(txn.Set([]byte("a"), []byte("3")), IsNil)
+	err = txn.Commit()
+	c.Assert(err, NotNil)
+	c.Assert(kv.IsRetryableError(err), IsFalse)
+}
+
+func (s *testTxnSuite) TestSavepoint(c *C) {
+	s.mustPut(c, "d", "d0")
+	txn := s.begin(c)
+	buffered := func() []string {
+		var res []string
+		c.Assert(txn.WalkBuffer(func(k kv.Key, v []byte) error {
+			res = append(res, string(k)+"="+string(v))
+			return nil
+		}), IsNil)
+		return res
+	}
+	c.Assert(txn.Set([]byte("a"), []byte("a1")), IsNil)
+	c.Assert(txn.Delete([]byte("d")), IsNil)
+	c.Assert(txn.SetSavepoint("sp1"), IsNil)
+	c.Assert(txn.Set([]byte("a"), []byte("a2")), IsNil)
+	c.Assert(txn.Set([]byte("b"), []byte("b2")), IsNil)
+	c.Assert(txn.SetSavepoint("sp2"), IsNil)
+	c.Assert(txn.Set([]byte("c"), []byte("c3")), IsNil)
+	c.Assert(buffered(), DeepEquals, []string{"a=a2", "b=b2", "c=c3", "d="})
+
+	c.Assert(txn.RollbackToSavepoint("sp2"), IsNil)
+	c.Assert(buffered(), DeepEquals, []string{"a=a2", "b=b2", "d="})
+	c.Assert(txn.RollbackToSavepoint("sp1"), IsNil)
+	c.Assert(buffered(), DeepEquals, []string{"a=a1", "d="})
+	// sp2 is invalidated by rolling back to sp1, which is kept.
+	err := txn.RollbackToSavepoint("sp2")
+	c.Assert(errors.Cause(err), Equals, errSavepointNotExist)
+	c.Assert(txn.Set([]byte("b"), []byte("b4")), IsNil)
+	c.Assert(txn.RollbackToSavepoint("sp1"), IsNil)
+	c.Assert(buffered(), DeepEquals, []string{"a=a1", "d="})
+	_, err = txn.Get([]byte("b"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+	_, err = txn.Get([]byte("d"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+
+	err = txn.SetSavepoint("")
+	c.Assert(errors.Cause(err), Equals, errEmptySavepointName)
+
+	// Setting a savepoint again moves it.
+	c.Assert(txn.Set([]byte("e"), []byte("e5")), IsNil)
+	c.Assert(txn.SetSavepoint("sp1"), IsNil)
+	c.Assert(txn.Set([]byte("f"), []byte("f5")), IsNil)
+	c.Assert(txn.RollbackToSavepoint("sp1"), IsNil)
+	c.Assert(buffered(), DeepEquals, []string{"a=a1", "d=", "e=e5"})
+
+	c.Assert(txn.Commit(), IsNil)
+	c.Assert(txn.SetSavepoint("sp1"), Equals, kv.ErrInvalidTxn)
+	txn = s.begin(c)
+	c.Assert(buffered(), HasLen, 0)
+	val, err := txn.Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "a1")
+	_, err = txn.Get([]byte("d"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+	_, err = txn.Get([]byte("f"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+}
+
+func (s *testTxnSuite) TestSavepointTxnState(c *C) {
+	s.mustPut(c, "a", "a0")
+	txn := s.begin(c)
+	c.Assert(txn.LockKeys(kv.Key("x")), IsNil)
+	c.Assert(txn.SetSavepoint("sp"), IsNil)
+	c.Assert(txn.LockKeys(kv.Key("y")), IsNil)
+	c.Assert(txn.Set([]byte("b"), []byte("b1")), IsNil)
+	txn.SetOption(kv.PresumeKeyNotExists, nil)
+	_, err := txn.Get([]byte("a"))
+	c.Assert(terror.ErrorEqual(err, kv.ErrNotExist), IsTrue)
+	txn.DelOption(kv.PresumeKeyNotExists)
+	c.Assert(txn.IsReadOnly(), IsFalse)
+
+	c.Assert(txn.RollbackToSavepoint("sp"), IsNil)
+	c.Assert(txn.IsReadOnly(), IsTrue)
+	c.Assert(txn.lockKeys, DeepEquals, [][]byte{[]byte("x")})
+	// The lazy check on "a" is discarded, so the commit succeeds.
+	c.Assert(txn.Set([]byte("c"), []byte("c1")), IsNil)
+	c.Assert(txn.Commit(), IsNil)
+}
+
+func (s *testTxnSuite) TestMaxExecutionTime(c *C) {
+	s.mustPut(c, "a", "a0")
+	txn := s.begin(c)
+	txn.SetOption(kv.MaxExecutionTime, 100*time.Millisecond)
+	_, err := txn.Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(txn.Set([]byte("b"), []byte("b1")), IsNil)
+
+	// Pretend that the txn started long ago.
+	txn.startTime -= monotime.Time(time.Second)
+	_, err = txn.Get([]byte("a"))
+	c.Assert(kv.ErrMaxExecTimeExceeded.Equal(err), IsTrue)
+	_, err = txn.BatchGet([]kv.Key{kv.Key("a"), kv.Key("b")})
+	c.Assert(kv.ErrMaxExecTimeExceeded.Equal(err), IsTrue)
+	err = txn.Set([]byte("c"), []byte("c1"))
+	c.Assert(kv.ErrMaxExecTimeExceeded.Equal(err), IsTrue)
+	err = txn.Delete([]byte("a"))
+	c.Assert(kv.ErrMaxExecTimeExceeded.Equal(err), IsTrue)
+	_, err = txn.Seek([]byte("a"))
+	c.Assert(kv.ErrMaxExecTimeExceeded.Equal(err), IsTrue)
+	err = txn.Commit()
+	c.Assert(kv.ErrMaxExecTimeExceeded.Equal(err), IsTrue)
+	_, err = s.begin(c).Get([]byte("b"))
+	c.Assert(kv.IsErrNotFound(err), IsTrue)
+
+	// A txn without the option never times out.
+	txn = s.begin(c)
+	txn.startTime -= monotime.Time(time.Hour)
+	c.Assert(txn.Set([]byte("b"), []byte("b2")), IsNil)
+	c.Assert(txn.Commit(), IsNil)
+}